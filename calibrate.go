@@ -0,0 +1,139 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"crypto/rand"
+	"runtime"
+	"time"
+)
+
+//
+//
+// CALIBRATION
+//
+//
+
+// calibrateDerive returns how long a derivation with 'k' takes on this machine.
+var calibrateDerive = func(k KDF) time.Duration {
+	var password, salt [SaltLength]byte
+	rand.Read(password[:])
+	rand.Read(salt[:])
+
+	start := time.Now()
+	key, _ := k.Derive(password[:], salt[:])
+	elapsed := time.Since(start)
+	wipe(key)
+	return elapsed
+}
+
+// calibrateBudget checks the calibration arguments and returns the memory
+// budget within the default reader limits.
+func calibrateBudget(target time.Duration, maxMemory uint64) (uint64, error) {
+	if target <= 0 {
+		return 0, ErrUnsupported
+	}
+	if maxMemory > DefaultMaxKDFMemory {
+		maxMemory = DefaultMaxKDFMemory
+	}
+	if maxMemory < DefaultMinKDFMemory {
+		return 0, ErrUnsafe
+	}
+	return maxMemory, nil
+}
+
+// passes returns how many times a derivation taking 'elapsed' fits in
+// 'target', at least one and at most 'max'.
+func passes(target, elapsed time.Duration, max uint64) uint64 {
+	n := uint64(1)
+	if elapsed > 0 && target/elapsed > 1 {
+		n = uint64(target / elapsed)
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+// CalibrateArgon2 benchmarks Argon2id on the current machine and returns
+// the strongest parameters deriving a key in about 'target' with at most
+// 'maxMemory' bytes: it uses as much memory as the time allows, one thread
+// per CPU, then as many passes as fit in the target. The parameters stay
+// within the default ReaderOptions limits, ErrUnsafe is returned when even
+// the minimum memory does not fit in 'target'.
+func CalibrateArgon2(target time.Duration, maxMemory uint64) (Argon2Params, error) {
+	maxMemory, err := calibrateBudget(target, maxMemory)
+	if err != nil {
+		return Argon2Params{}, err
+	}
+
+	threads := runtime.NumCPU()
+	if threads > 255 {
+		threads = 255
+	}
+
+	p := Argon2Params{
+		CostTime:    1,
+		CostMemory:  uint32(maxMemory / 1024),
+		CostThreads: uint8(threads),
+		KeyLength:   keyLength,
+	}
+
+	// one pass over the memory must fit
+	elapsed := calibrateDerive(p)
+	for elapsed > target {
+		if uint64(p.CostMemory)*1024/2 < DefaultMinKDFMemory {
+			return Argon2Params{}, ErrUnsafe
+		}
+		p.CostMemory /= 2
+		elapsed = calibrateDerive(p)
+	}
+
+	p.CostTime = uint32(passes(target, elapsed, DefaultMaxKDFTime))
+	return p, nil
+}
+
+// CalibrateScrypt benchmarks scrypt on the current machine and returns the
+// strongest parameters deriving a key in about 'target' with at most
+// 'maxMemory' bytes: r = 8 and the largest power of two N the time allows,
+// then as many p as fit in the target. The parameters stay within the
+// default ReaderOptions limits, ErrUnsafe is returned when even the minimum
+// memory does not fit in 'target'.
+func CalibrateScrypt(target time.Duration, maxMemory uint64) (ScryptParams, error) {
+	maxMemory, err := calibrateBudget(target, maxMemory)
+	if err != nil {
+		return ScryptParams{}, err
+	}
+
+	p := ScryptParams{
+		CostParam: 1,
+		CostN:     8,
+		CostP:     1,
+		SaltLen:   SaltLength,
+		KeyLength: keyLength,
+	}
+
+	// the largest N within the memory budget, with up to the largest p
+	for {
+		q := p
+		q.CostParam *= 2
+		q.CostP = int(DefaultMaxKDFTime / 2)
+		if memory, _ := q.Cost(); memory > maxMemory {
+			break
+		}
+		p.CostParam *= 2
+	}
+
+	elapsed := calibrateDerive(p)
+	for elapsed > target {
+		p.CostParam /= 2
+		if memory, _ := p.Cost(); memory < DefaultMinKDFMemory {
+			return ScryptParams{}, ErrUnsafe
+		}
+		elapsed = calibrateDerive(p)
+	}
+
+	// every p is two passes over the memory
+	p.CostP = int(passes(target, elapsed, DefaultMaxKDFTime/2))
+	return p, nil
+}
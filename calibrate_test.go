@@ -0,0 +1,122 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeDerive replaces the calibration benchmark by a machine deriving
+// 'rate' bytes per millisecond and returns a restore function.
+func fakeDerive(rate uint64) func() {
+	derive := calibrateDerive
+	calibrateDerive = func(k KDF) time.Duration {
+		memory, passes := k.Cost()
+		return time.Duration(memory*passes/rate) * time.Millisecond
+	}
+	return func() {
+		calibrateDerive = derive
+	}
+}
+
+/*
+ *
+ *
+ *
+ *
+ * CALIBRATION TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestCalibrateArgon2(t *testing.T) {
+	// 1 MiB per millisecond
+	defer fakeDerive(1024 * 1024)()
+
+	// 64 MiB takes 64ms, 15 passes fit
+	p, err := CalibrateArgon2(time.Second, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.CostMemory != 64*1024 || p.CostTime != 15 || p.CostThreads < 1 {
+		t.Errorf("unexpected params %v", p)
+	}
+
+	// 512 MiB is too slow, 128 MiB fits once
+	p, err = CalibrateArgon2(200*time.Millisecond, 512*1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.CostMemory != 128*1024 || p.CostTime != 1 {
+		t.Errorf("unexpected params %v", p)
+	}
+
+	if err = (ReaderOptions{}).checkKDF(p); err != nil {
+		t.Errorf("calibrated params out of the reader limits: %v", err)
+	}
+}
+
+func TestCalibrateScrypt(t *testing.T) {
+	defer fakeDerive(1024 * 1024)()
+
+	// N = 32768 for 64 MiB, the p blocks do not fit with N = 65536, every
+	// p is two passes of 32ms
+	p, err := CalibrateScrypt(time.Second, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.CostParam != 32768 || p.CostN != 8 || p.CostP != 15 {
+		t.Errorf("unexpected params %v", p)
+	}
+
+	if err = (ReaderOptions{}).checkKDF(p); err != nil {
+		t.Errorf("calibrated params out of the reader limits: %v", err)
+	}
+}
+
+func TestCalibrateLimits(t *testing.T) {
+	defer fakeDerive(1024 * 1024)()
+
+	// the memory is capped to the default reader limit
+	p, err := CalibrateArgon2(time.Hour, 1<<40)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = (ReaderOptions{}).checkKDF(p); err != nil {
+		t.Errorf("calibrated params out of the reader limits: %v (%v)", err, p)
+	}
+
+	// too slow for the minimum memory
+	_, err = CalibrateArgon2(time.Millisecond, 64*1024*1024)
+	if err != ErrUnsafe {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsafe)
+	}
+	_, err = CalibrateScrypt(time.Millisecond, 64*1024*1024)
+	if err != ErrUnsafe {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsafe)
+	}
+
+	// not enough memory
+	_, err = CalibrateArgon2(time.Second, 1024*1024)
+	if err != ErrUnsafe {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsafe)
+	}
+
+	_, err = CalibrateScrypt(0, 64*1024*1024)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestCalibrateArgon2Machine(t *testing.T) {
+	p, err := CalibrateArgon2(time.Second, DefaultMinKDFMemory)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.CostMemory != DefaultMinKDFMemory/1024 || p.CostTime < 1 {
+		t.Errorf("unexpected params %v", p)
+	}
+}
@@ -0,0 +1,130 @@
+// +build go1.13
+
+// Copyright 2016-2018 (c) Eric "eau" Augé <eau+naclpipe@unix4fun.net>
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// naclpipe package
+	"github.com/unix4fun/naclpipe"
+)
+
+// formatKDF returns the -kdf value of calibrated parameters:
+//	argon2id:t=<passes>,m=<memory KiB>,p=<threads>
+//	scrypt:N=<cost>,r=<block size>,p=<parallelism>
+func formatKDF(k naclpipe.KDF) string {
+	switch v := k.(type) {
+	case naclpipe.Argon2Params:
+		return fmt.Sprintf("argon2id:t=%d,m=%d,p=%d", v.CostTime, v.CostMemory, v.CostThreads)
+	case naclpipe.ScryptParams:
+		return fmt.Sprintf("scrypt:N=%d,r=%d,p=%d", v.CostParam, v.CostN, v.CostP)
+	}
+	return ""
+}
+
+// parseKDF parses a -kdf value, "@file" reads it from a file saved by np calibrate.
+func parseKDF(spec string) (naclpipe.KDF, error) {
+	if strings.HasPrefix(spec, "@") {
+		b, err := ioutil.ReadFile(spec[1:])
+		if err != nil {
+			return nil, err
+		}
+		spec = strings.TrimSpace(string(b))
+	}
+
+	invalid := fmt.Errorf("invalid key derivation parameters %q", spec)
+	fields := strings.SplitN(spec, ":", 2)
+	if len(fields) != 2 {
+		return nil, invalid
+	}
+
+	values := make(map[string]uint32)
+	for _, kv := range strings.Split(fields[1], ",") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return nil, invalid
+		}
+		v, err := strconv.ParseUint(pair[1], 10, 32)
+		if err != nil {
+			return nil, invalid
+		}
+		values[pair[0]] = uint32(v)
+	}
+
+	switch {
+	case fields[0] == "argon2id" && len(values) == 3 && values["p"] <= 255:
+		return naclpipe.Argon2Params{CostTime: values["t"], CostMemory: values["m"], CostThreads: uint8(values["p"])}, nil
+	case fields[0] == "scrypt" && len(values) == 3:
+		return naclpipe.ScryptParams{CostParam: int(values["N"]), CostN: int(values["r"]), CostP: int(values["p"])}, nil
+	}
+	return nil, invalid
+}
+
+// calibrateUsage display the calibrate command line usage
+func calibrateUsage(fs *flag.FlagSet) func() {
+	return func() {
+		banner(os.Args[0])
+		fmt.Printf("%s calibrate [options]\n", os.Args[0])
+		fmt.Printf("benchmark the key derivation on this machine and print the strongest parameters\n")
+		fmt.Printf("within the time and memory budget, to be used with %s -kdf\n", os.Args[0])
+		fmt.Printf("--\n")
+		fs.PrintDefaults()
+	}
+}
+
+// calibrate prints (or saves) the key derivation parameters fitting the budget.
+func calibrate(args []string) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	fs.Usage = calibrateUsage(fs)
+
+	algFlag := fs.String("a", "argon", "scrypt|argon derivation to calibrate")
+	timeFlag := fs.Duration("t", time.Second, "target derivation time")
+	memFlag := fs.Uint64("m", 256, "maximum derivation memory in MiB")
+	outFlag := fs.String("o", "", "save the parameters to this file (use with -kdf @file)")
+	hlpFlag := fs.Bool("h", false, "help")
+
+	fs.Parse(args)
+
+	if len(fs.Args()) != 0 || *hlpFlag == true {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var k naclpipe.KDF
+	var err error
+
+	switch derivationFromName(*algFlag) {
+	case naclpipe.DerivateArgon2id:
+		k, err = naclpipe.CalibrateArgon2(*timeFlag, *memFlag*1024*1024)
+	case naclpipe.DerivateScrypt:
+		k, err = naclpipe.CalibrateScrypt(*timeFlag, *memFlag*1024*1024)
+	default:
+		err = naclpipe.ErrUnsupported
+	}
+	if errors.Is(err, naclpipe.ErrUnsafe) {
+		fmt.Fprintf(os.Stderr, "np: the minimum key derivation memory does not fit in the time or memory budget\n")
+		os.Exit(1)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(*outFlag) == 0 {
+		fmt.Println(formatKDF(k))
+		return
+	}
+
+	err = ioutil.WriteFile(*outFlag, []byte(formatKDF(k)+"\n"), 0644)
+	if err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,124 @@
+// +build go1.13
+
+// Copyright 2016-2018 (c) Eric "eau" Augé <eau+naclpipe@unix4fun.net>
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+
+	// naclpipe package
+	"github.com/unix4fun/naclpipe"
+	"golang.org/x/crypto/ed25519"
+)
+
+// keygenUsage display the keygen command line usage
+func keygenUsage(fs *flag.FlagSet) func() {
+	return func() {
+		banner(os.Args[0])
+		fmt.Printf("%s keygen [options]\n", os.Args[0])
+		fmt.Printf("generate a random 256-bit key file to use with %s -K instead of a password\n", os.Args[0])
+		fmt.Printf("or an X25519 identity file for %s -d -i, its public key is the %s -r recipient\n", os.Args[0], os.Args[0])
+		fmt.Printf("or an Ed25519 signing key file for %s -sign, its public key is the %s -d -signer\n", os.Args[0], os.Args[0])
+		fmt.Printf("--\n")
+		fmt.Printf("[environment variables]\n")
+		fmt.Printf("NPKEYPASS: (same as -p)\n")
+		fmt.Printf("--\n")
+		fs.PrintDefaults()
+	}
+}
+
+// keygen writes a new key file to the -o path or to stdout.
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Usage = keygenUsage(fs)
+
+	outFlag := fs.String("o", "", "key file to create (default: stdout)")
+	passFlag := fs.String("p", "", "passphrase protecting the key file (default: none)")
+	identityFlag := fs.Bool("identity", false, "generate an X25519 identity instead of a key, prints the public key")
+	signingFlag := fs.Bool("signing", false, "generate an Ed25519 signing key instead of a key, prints the public key")
+	hlpFlag := fs.Bool("h", false, "help")
+
+	fs.Parse(args)
+
+	if len(fs.Args()) != 0 || *hlpFlag == true || (*identityFlag == true && *signingFlag == true) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	passphrase := *passFlag
+	if passEnv := os.Getenv(EnvKeyPass); len(passEnv) > 0 {
+		passphrase = passEnv
+	}
+
+	if *identityFlag == true {
+		keygenIdentity(*outFlag, passphrase)
+		return
+	}
+	if *signingFlag == true {
+		keygenSigning(*outFlag, passphrase)
+		return
+	}
+
+	key, err := naclpipe.GenerateKey()
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(*outFlag) == 0 {
+		err = naclpipe.WriteKeyFile(os.Stdout, key, passphrase)
+	} else {
+		err = naclpipe.SaveKeyFile(*outFlag, key, passphrase)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// keygenIdentity writes a new identity file to 'out' or to stdout, the
+// file comments hold the public key which is also printed when saved.
+func keygenIdentity(out, passphrase string) {
+	publicKey, identity, err := naclpipe.GenerateIdentity()
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(out) == 0 {
+		err = naclpipe.WriteIdentityFile(os.Stdout, identity, passphrase)
+	} else {
+		err = naclpipe.SaveIdentityFile(out, identity, passphrase)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(out) > 0 {
+		fmt.Println(base64.StdEncoding.EncodeToString(publicKey[:]))
+	}
+}
+
+// keygenSigning writes a new signing key file to 'out' or to stdout, see
+// keygenIdentity.
+func keygenSigning(out, passphrase string) {
+	publicKey, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(out) == 0 {
+		err = naclpipe.WriteSigningKeyFile(os.Stdout, signer, passphrase)
+	} else {
+		err = naclpipe.SaveSigningKeyFile(out, signer, passphrase)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(out) > 0 {
+		fmt.Println(base64.StdEncoding.EncodeToString(publicKey))
+	}
+}
@@ -1,4 +1,4 @@
-// +build go1.7
+// +build go1.13
 
 // Copyright 2016-2018 (c) Eric "eau" Augé <eau+naclpipe@unix4fun.net>
 
@@ -7,13 +7,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
 	// naclpipe package
 	"github.com/unix4fun/naclpipe"
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
@@ -23,6 +28,10 @@ const (
 	Version                                 = "0.2.1"
 	EnvAlg                                  = "NPALG"
 	EnvKey                                  = "NPKEY"
+	EnvNewKey                               = "NPNEWKEY"
+	EnvKDF                                  = "NPKDF"
+	EnvKeyPass                              = "NPKEYPASS"
+	EnvCipher                               = "NPCIPHER"
 )
 
 // banner is just a banner function.
@@ -35,15 +44,160 @@ func banner(cmd string) {
 func usage() {
 	banner(os.Args[0])
 	fmt.Printf("%s [options]\n", os.Args[0])
+	fmt.Printf("%s upgrade [options] (re-encrypt a legacy stream, see %s upgrade -h)\n", os.Args[0], os.Args[0])
+	fmt.Printf("%s calibrate [options] (key derivation parameters for -kdf, see %s calibrate -h)\n", os.Args[0], os.Args[0])
+	fmt.Printf("%s keygen [options] (random key file for -K or identity for -i, see %s keygen -h)\n", os.Args[0], os.Args[0])
+	fmt.Printf("%s rekey -i file [options] (change the key or recipients of a file in place, see %s rekey -h)\n", os.Args[0], os.Args[0])
 	fmt.Printf("--\n")
 	fmt.Printf("[environment variables]\n")
 	fmt.Printf("NPKEY: (same as -k)\n")
 	fmt.Printf("NPALG: (same as -a)\n")
+	fmt.Printf("NPKDF: (same as -kdf)\n")
+	fmt.Printf("NPKEYPASS: (same as -kp)\n")
+	fmt.Printf("NPCIPHER: (same as -cipher)\n")
 	fmt.Printf("--\n")
 	flag.PrintDefaults()
 }
 
+// fatal explains what went wrong and exits.
+func fatal(err error) {
+	var authErr *naclpipe.AuthError
+	var writeErr *naclpipe.WriteError
+
+	switch {
+	case errors.As(err, &authErr):
+		fmt.Fprintf(os.Stderr, "np: corrupted stream: chunk %d at byte offset %d failed authentication\n", authErr.Chunk, authErr.Offset)
+	case errors.As(err, &writeErr):
+		fmt.Fprintf(os.Stderr, "np: output error: %v\n", writeErr.Err)
+	case errors.Is(err, naclpipe.ErrWrongKey):
+		fmt.Fprintf(os.Stderr, "np: wrong key, key file passphrase (or derivation), the stream cannot be decrypted\n")
+	case errors.Is(err, naclpipe.ErrBadKeyFile):
+		fmt.Fprintf(os.Stderr, "np: invalid key file (malformed or checksum mismatch)\n")
+	case errors.Is(err, naclpipe.ErrKDFLimits):
+		fmt.Fprintf(os.Stderr, "np: the key derivation costs are too high (or too low) for a default reader\n")
+	case errors.Is(err, naclpipe.ErrNotEnvelope):
+		fmt.Fprintf(os.Stderr, "np: only streams encrypted for recipients (-r) can be rekeyed, the key of a password or key file stream only changes by re-encrypting it (see np upgrade)\n")
+	case errors.Is(err, naclpipe.ErrContextMismatch):
+		fmt.Fprintf(os.Stderr, "np: wrong context, the stream was written with other associated data (-context)\n")
+	case errors.Is(err, naclpipe.ErrBadSignature):
+		fmt.Fprintf(os.Stderr, "np: bad signature, the stream was modified or is not signed by a trusted signer\n")
+	case errors.Is(err, naclpipe.ErrTruncated):
+		fmt.Fprintf(os.Stderr, "np: truncated stream, the end of the data is missing\n")
+	case errors.Is(err, naclpipe.ErrTrailingData):
+		fmt.Fprintf(os.Stderr, "np: unexpected data after the end of the stream\n")
+	case errors.Is(err, naclpipe.ErrBadHeader):
+		fmt.Fprintf(os.Stderr, "np: invalid stream header\n")
+	case errors.Is(err, naclpipe.ErrUnsupportedVersion):
+		fmt.Fprintf(os.Stderr, "np: unsupported stream format version, try a newer np\n")
+	case errors.Is(err, naclpipe.ErrUnsafe):
+		fmt.Fprintf(os.Stderr, "np: unsafe key or salt (keys need at least 5 characters)\n")
+	case errors.Is(err, naclpipe.ErrUnsupported):
+		fmt.Fprintf(os.Stderr, "np: unsupported option\n")
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		fmt.Fprintf(os.Stderr, "np: empty or truncated input\n")
+	default:
+		fmt.Fprintf(os.Stderr, "np: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+// recipients collects the repeated -r public keys.
+type recipients []*[32]byte
+
+func (r *recipients) String() string {
+	return fmt.Sprintf("%d recipient(s)", len(*r))
+}
+
+// Set decodes a standard base64 X25519 public key.
+func (r *recipients) Set(s string) error {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return fmt.Errorf("invalid recipient public key %q", s)
+	}
+	publicKey := new([32]byte)
+	copy(publicKey[:], b)
+	*r = append(*r, publicKey)
+	return nil
+}
+
+// signers collects the repeated -signer public keys.
+type signers []ed25519.PublicKey
+
+func (s *signers) String() string {
+	return fmt.Sprintf("%d signer(s)", len(*s))
+}
+
+// Set decodes a standard base64 Ed25519 public key.
+func (s *signers) Set(v string) error {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid signer public key %q", v)
+	}
+	*s = append(*s, ed25519.PublicKey(b))
+	return nil
+}
+
+// trusts reports whether the stream signer 'signer' is one of 's', every
+// signer is trusted when there are none.
+func (s signers) trusts(signer ed25519.PublicKey) bool {
+	for _, publicKey := range s {
+		if bytes.Equal(publicKey, signer) {
+			return true
+		}
+	}
+	return len(s) == 0
+}
+
+// suiteFromName returns the naclpipe cipher suite for the -cipher option.
+func suiteFromName(name string) (naclpipe.CipherSuite, bool) {
+	for _, suite := range []naclpipe.CipherSuite{
+		naclpipe.SuiteSecretbox,
+		naclpipe.SuiteXChaCha20Poly1305,
+		naclpipe.SuiteAES256GCM,
+	} {
+		if suite.String() == name {
+			return suite, true
+		}
+	}
+	return naclpipe.SuiteSecretbox, false
+}
+
+// derivationFromName returns the naclpipe derivation for the -a option.
+func derivationFromName(alg string) int {
+	switch alg {
+	case "scrypt":
+		return naclpipe.DerivateScrypt
+	case "scrypt010":
+		return naclpipe.DerivateScrypt010
+	}
+	return naclpipe.DerivateArgon2id
+}
+
+// passwordWriter encrypts for 'password' stretched with 'kdf' (nil for the
+// Argon2id defaults) in a single slot envelope, np rekey replaces it.
+func passwordWriter(w io.Writer, opts naclpipe.Options, password string, kdf naclpipe.KDF) (*naclpipe.Writer, error) {
+	return naclpipe.NewEnvelopeWriterWithOptions(w, opts, naclpipe.PasswordRecipient(password, kdf))
+}
+
 func main() {
+	// sub commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "upgrade":
+			upgrade(os.Args[2:])
+			return
+		case "calibrate":
+			calibrate(os.Args[2:])
+			return
+		case "keygen":
+			keygen(os.Args[2:])
+			return
+		case "rekey":
+			rekey(os.Args[2:])
+			return
+		}
+	}
+
 	// setup basic usage messages */
 	flag.Usage = usage
 
@@ -52,20 +206,56 @@ func main() {
 	decFlag := flag.Bool("d", false, "decrypt")
 
 	// algorithm, unknown == argon2id
-	algFlag := flag.String("a", "argon", "scrypt|argon")
+	// the decryption reads it from the stream header, except for legacy v0.2 streams
+	algFlag := flag.String("a", "argon", "scrypt|argon (encryption or legacy v0.2 decryption), scrypt010 (legacy decryption)")
+
+	// key derivation parameters, supersede -a
+	kdfFlag := flag.String("kdf", "", "key derivation parameters (encryption) as printed by np calibrate, or @file")
+
+	// chunk AEAD, decryption reads it from the stream header
+	cipherFlag := flag.String("cipher", "secretbox", "secretbox|xchacha20poly1305|aes256gcm (encryption)")
 
 	// buffer size
-	szFlag := flag.Int("s", defaultBufferSize, "buffer size")
+	szFlag := flag.Int("s", defaultBufferSize, "buffer size (chunk size of legacy v0.2 streams)")
 
 	/* key to provide */
 	keyFlag := flag.String("k", defaultInsecureHardcodedKeyForLazyFolks, "key value")
 
+	// or a key file, no key derivation
+	keyFileFlag := flag.String("K", "", "key file (see np keygen), supersedes -k")
+	keyPassFlag := flag.String("kp", "", "passphrase of a protected key, identity or signing key file")
+	detFlag := flag.Bool("deterministic", false, "deterministic encryption with -K, the same key and input give the same output")
+
+	// or public keys, no shared secret
+	var recipientsFlag recipients
+	flag.Var(&recipientsFlag, "r", "recipient public key (encryption, repeat for several recipients, see np keygen -identity), with -k the password also decrypts")
+	identityFlag := flag.String("i", "", "identity file (decryption of a stream encrypted with -r)")
+
+	// sender authentication
+	signFlag := flag.String("sign", "", "signing key file (encryption, see np keygen -signing), signs the stream")
+	var signersFlag signers
+	flag.Var(&signersFlag, "signer", "trusted signer public key (decryption, repeat for several signers), unsigned or otherwise signed streams fail")
+	detachFlag := flag.String("detach", "", "detached signature file of the encrypted stream, written with -sign or checked with -signer (the plaintext is written before the signature is checked, see -restore-name)")
+
+	// stream context, the same on both sides
+	contextFlag := flag.String("context", "", "associated data binding the stream to its context (object path, tenant...), decryption needs the same")
+
+	// file metadata, encrypted in the stream header
+	fileFlag := flag.String("f", "", "input file instead of stdin (encryption), its name, mode, modification time, size and content type are encrypted in the stream")
+	restoreFlag := flag.Bool("restore-name", false, "write to the file name of the stream metadata with its mode and modification time instead of stdout (decryption)")
+
 	//dbgFlag := flag.Bool("v", false, "verbose log")
 	hlpFlag := flag.Bool("h", false, "help")
 
 	flag.Parse()
 
-	if len(flag.Args()) != 0 || *hlpFlag == true {
+	// a detached signature is written with a signing key or checked with trusted signers
+	detached := len(*detachFlag) > 0
+	if len(flag.Args()) != 0 || *hlpFlag == true ||
+		(detached && *decFlag == false && len(*signFlag) == 0) ||
+		(detached && *decFlag == true && len(signersFlag) == 0) ||
+		(*detFlag == true && (*decFlag == true || len(*keyFileFlag) == 0 || len(recipientsFlag) > 0)) ||
+		(*restoreFlag == true && *decFlag == false) || (len(*fileFlag) > 0 && *decFlag == true) {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -83,14 +273,73 @@ func main() {
 		password = keyEnv
 	}
 
+	// was a password given rather than the default one
+	passwordSet := len(keyEnv) > 0
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "k" {
+			passwordSet = true
+		}
+	})
+
 	if len(keyDerivationAlgEnv) > 0 {
 		alg = keyDerivationAlgEnv
 	}
 
 	// derivation..
-	derivation := naclpipe.DerivateArgon2id
-	if alg == "scrypt" {
-		derivation = naclpipe.DerivateScrypt
+	derivation := derivationFromName(alg)
+
+	cipherName := *cipherFlag
+	if cipherEnv := os.Getenv(EnvCipher); len(cipherEnv) > 0 {
+		cipherName = cipherEnv
+	}
+	suite, ok := suiteFromName(cipherName)
+	if ok != true {
+		fmt.Fprintf(os.Stderr, "np: unknown cipher suite %q\n", cipherName)
+		os.Exit(1)
+	}
+	if *detFlag == true && suite == naclpipe.SuiteAES256GCM {
+		fmt.Fprintf(os.Stderr, "np: -deterministic does not support the %s cipher suite\n", suite)
+		os.Exit(1)
+	}
+
+	kdfSpec := *kdfFlag
+	if kdfEnv := os.Getenv(EnvKDF); len(kdfEnv) > 0 {
+		kdfSpec = kdfEnv
+	}
+
+	keyPass := *keyPassFlag
+	if keyPassEnv := os.Getenv(EnvKeyPass); len(keyPassEnv) > 0 {
+		keyPass = keyPassEnv
+	}
+
+	// a key file bypasses the key derivation
+	var key *[32]byte
+	if len(*keyFileFlag) > 0 {
+		var err error
+		key, err = naclpipe.LoadKeyFile(*keyFileFlag, keyPass)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// so does an identity
+	var identity *[32]byte
+	if len(*identityFlag) > 0 {
+		var err error
+		identity, err = naclpipe.LoadIdentityFile(*identityFlag, keyPass)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// and a signing key signs
+	var signer ed25519.PrivateKey
+	if len(*signFlag) > 0 {
+		var err error
+		signer, err = naclpipe.LoadSigningKeyFile(*signFlag, keyPass)
+		if err != nil {
+			fatal(err)
+		}
 	}
 
 	// we define env variables to supersede command line params
@@ -100,9 +349,67 @@ func main() {
 	switch *decFlag {
 	case true:
 		// Decrypt
-		crd, err := naclpipe.NewReader(os.Stdin, password, derivation)
+		// the detached signature covers the encrypted input
+		var input io.Reader = os.Stdin
+		var digest *naclpipe.Digest
+		var embeddedSigners signers = signersFlag
+		var signature []byte
+		if detached {
+			// an untrusted signer fails before any plaintext is written,
+			// the signature itself is only checked at the end of the stream
+			var err error
+			signature, err = ioutil.ReadFile(*detachFlag)
+			if err != nil {
+				fatal(err)
+			}
+			if len(signature) != naclpipe.DetachedSignatureSize ||
+				signersFlag.trusts(signature[:ed25519.PublicKeySize]) != true {
+				fatal(naclpipe.ErrBadSignature)
+			}
+			digest = naclpipe.NewDigest()
+			input = io.TeeReader(os.Stdin, digest)
+			embeddedSigners = nil
+		}
+
+		// legacy headerless streams were chunked with the writer buffer size
+		var crd *naclpipe.Reader
+		var err error
+		ropts := naclpipe.ReaderOptions{
+			TrustedSigners: embeddedSigners,
+			AssociatedData: []byte(*contextFlag),
+		}
+		switch {
+		case identity != nil:
+			crd, err = naclpipe.NewReaderWithIdentityOptions(input, identity, ropts)
+		case key != nil:
+			crd, err = naclpipe.NewReaderWithKeyOptions(input, key, ropts)
+		default:
+			if bufSize <= 0 {
+				fatal(naclpipe.ErrUnsupported)
+			}
+			ropts.Derivation = derivation
+			ropts.LegacyChunkSize = bufSize
+			crd, err = naclpipe.NewReaderWithOptions(input, password, ropts)
+		}
 		if err != nil {
-			panic(err)
+			fatal(err)
+		}
+		if embeddedSigners.trusts(crd.Signer()) != true {
+			fatal(naclpipe.ErrBadSignature)
+		}
+
+		// a partially restored file is removed
+		var plain io.Writer = os.Stdout
+		var restored *os.File
+		abort := fatal
+		if *restoreFlag == true {
+			restored = restoreOutput(crd.Metadata())
+			plain = restored
+			abort = func(err error) {
+				restored.Close()
+				os.Remove(restored.Name())
+				fatal(err)
+			}
 		}
 
 	DecryptLoop:
@@ -114,30 +421,95 @@ func main() {
 			case nil:
 				break
 			default:
-				panic(err)
+				abort(err)
 			} // end of Switch
 
-			_, err = os.Stdout.Write(buf[:n])
+			_, err = plain.Write(buf[:n])
 			if err != nil {
-				panic(err)
+				abort(err)
 			}
 		} // End of DecryptLoop
 
+		if digest != nil {
+			_, err = digest.Verify(signature, signersFlag)
+			if err != nil {
+				abort(err)
+			}
+		}
+
+		if restored != nil {
+			err = restoreDone(restored, crd.Metadata())
+			if err != nil {
+				abort(err)
+			}
+		}
+
 	default:
 		// Encrypt
-		cwr, err := naclpipe.NewWriter(os.Stdout, password, derivation)
+		// -a scrypt has its own default costs, -kdf overrides them
+		var kdf naclpipe.KDF
+		if len(kdfSpec) > 0 {
+			var err error
+			kdf, err = parseKDF(kdfSpec)
+			if err != nil {
+				fatal(err)
+			}
+		} else if derivation != naclpipe.DerivateArgon2id {
+			var err error
+			kdf, err = naclpipe.DefaultKDF(derivation)
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		// the signature is embedded unless detached
+		var output io.Writer = os.Stdout
+		var digest *naclpipe.Digest
+		opts := naclpipe.Options{
+			Signer:         signer,
+			CipherSuite:    suite,
+			Deterministic:  *detFlag,
+			AssociatedData: []byte(*contextFlag),
+		}
+		var plain io.Reader = os.Stdin
+		if len(*fileFlag) > 0 {
+			plain, opts.Metadata = metadataInput(*fileFlag)
+		}
+		if detached {
+			digest = naclpipe.NewDigest()
+			output = io.MultiWriter(os.Stdout, digest)
+			opts.Signer = nil
+		}
+
+		var cwr *naclpipe.Writer
+		var err error
+		if len(recipientsFlag) > 0 {
+			// an explicit password gets a slot next to the recipients
+			var slots []naclpipe.Recipient
+			for _, publicKey := range recipientsFlag {
+				slots = append(slots, naclpipe.X25519Recipient(publicKey))
+			}
+			if passwordSet {
+				slots = append(slots, naclpipe.PasswordRecipient(password, kdf))
+			}
+			cwr, err = naclpipe.NewEnvelopeWriterWithOptions(output, opts, slots...)
+		} else if key != nil {
+			cwr, err = naclpipe.NewWriterWithKeyOptions(output, key, opts)
+		} else {
+			cwr, err = passwordWriter(output, opts, password, kdf)
+		}
 		if err != nil {
-			panic(err)
+			fatal(err)
 		}
 
 	CryptLoop:
 		for {
-			n, err := io.ReadFull(os.Stdin, buf)
+			n, err := io.ReadFull(plain, buf)
 			switch err {
 			case io.ErrUnexpectedEOF:
 				_, err = cwr.Write(buf[:n])
 				if err != nil {
-					panic(err)
+					fatal(err)
 				}
 				fallthrough
 			case io.EOF:
@@ -145,14 +517,31 @@ func main() {
 			case nil:
 				break
 			default:
-				panic(err)
+				fatal(err)
 			} // end of Switch
 
 			// we need salt if it's the first block
 			_, err = cwr.Write(buf[:n])
 			if err != nil {
-				panic(err)
+				fatal(err)
 			}
 		} // End of CryptLoop
+
+		// seal the final block
+		err = cwr.Close()
+		if err != nil {
+			fatal(err)
+		}
+
+		if digest != nil {
+			signature, err := digest.Sign(signer)
+			if err != nil {
+				fatal(err)
+			}
+			err = ioutil.WriteFile(*detachFlag, signature, 0644)
+			if err != nil {
+				fatal(err)
+			}
+		}
 	} // End of switch()
 }
@@ -0,0 +1,71 @@
+// +build go1.13
+
+// Copyright 2016-2018 (c) Eric "eau" Augé <eau+naclpipe@unix4fun.net>
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	// naclpipe package
+	"github.com/unix4fun/naclpipe"
+)
+
+// metadataInput opens the input file 'path' and returns it with its
+// metadata, the content type is sniffed from its first bytes.
+func metadataInput(path string) (io.Reader, naclpipe.Metadata) {
+	f, err := os.Open(path)
+	if err != nil {
+		fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		fatal(err)
+	}
+
+	m := naclpipe.FileMetadata(fi)
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(512)
+	m[naclpipe.MetadataContentType] = http.DetectContentType(head)
+	return br, m
+}
+
+// restoreOutput creates the file named in the metadata 'm' in the current
+// directory, an existing file is never overwritten.
+func restoreOutput(m naclpipe.Metadata) *os.File {
+	name := m[naclpipe.MetadataName]
+	if len(name) == 0 || name != filepath.Base(name) || name == "." || name == ".." {
+		fmt.Fprintf(os.Stderr, "np: the stream has no file name to restore (or an unsafe one: %q)\n", name)
+		os.Exit(1)
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fatal(err)
+	}
+	return f
+}
+
+// restoreDone closes the restored file 'f' with the mode and modification
+// time of the metadata 'm'.
+func restoreDone(f *os.File, m naclpipe.Metadata) error {
+	if mode, ok := m.Mode(); ok {
+		err := f.Chmod(mode)
+		if err != nil {
+			return err
+		}
+	}
+	err := f.Close()
+	if err != nil {
+		return err
+	}
+	if mtime, ok := m.ModTime(); ok {
+		return os.Chtimes(f.Name(), mtime, mtime)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// +build go1.13
+
+// Copyright 2016-2018 (c) Eric "eau" Augé <eau+naclpipe@unix4fun.net>
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	// naclpipe package
+	"github.com/unix4fun/naclpipe"
+	"golang.org/x/crypto/curve25519"
+)
+
+// rekeyUsage display the rekey command line usage
+func rekeyUsage(fs *flag.FlagSet) func() {
+	return func() {
+		banner(os.Args[0])
+		fmt.Printf("%s rekey -i file [options]\n", os.Args[0])
+		fmt.Printf("replace (or add, or remove) a password or recipient of an encrypted file without re-encrypting it,\n")
+		fmt.Printf("the header is rewritten in place or, when it does not fit, the file is atomically rewritten\n")
+		fmt.Printf("streams written by an older %s with a password only cannot be rekeyed, see %s upgrade\n", os.Args[0], os.Args[0])
+		fmt.Printf("an in place rewrite is not atomic, keep a copy of files you cannot lose\n")
+		fmt.Printf("--\n")
+		fmt.Printf("[environment variables]\n")
+		fmt.Printf("NPKEY: (same as -k)\n")
+		fmt.Printf("NPNEWKEY: (same as -nk)\n")
+		fmt.Printf("NPKDF: (same as -kdf)\n")
+		fmt.Printf("NPKEYPASS: (same as -kp)\n")
+		fmt.Printf("--\n")
+		fs.PrintDefaults()
+	}
+}
+
+// rekey rewraps the file key of the -i file for the new credentials.
+func rekey(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	fs.Usage = rekeyUsage(fs)
+
+	fileFlag := fs.String("i", "", "encrypted file to rekey")
+
+	// the old credential
+	keyFlag := fs.String("k", defaultInsecureHardcodedKeyForLazyFolks, "key value")
+	identityFlag := fs.String("id", "", "identity file, supersedes -k")
+	keyPassFlag := fs.String("kp", "", "passphrase of a protected identity file")
+
+	// the new ones
+	newKeyFlag := fs.String("nk", "", "new key value")
+	var recipientsFlag recipients
+	fs.Var(&recipientsFlag, "r", "new recipient public key (repeat for several recipients)")
+	kdfFlag := fs.String("kdf", "", "key derivation parameters of the new key as printed by np calibrate, or @file")
+	addFlag := fs.Bool("add", false, "keep the old key or identity")
+	rmFlag := fs.Bool("rm", false, "remove the old key or identity, without -nk or -r")
+
+	hlpFlag := fs.Bool("h", false, "help")
+
+	fs.Parse(args)
+
+	newPassword := *newKeyFlag
+	if newKeyEnv := os.Getenv(EnvNewKey); len(newKeyEnv) > 0 {
+		newPassword = newKeyEnv
+	}
+
+	// removing must be explicit, adding and removing do not mix
+	replace := len(newPassword) > 0 || len(recipientsFlag) > 0
+	if len(fs.Args()) != 0 || *hlpFlag == true || len(*fileFlag) == 0 ||
+		replace == *rmFlag || (*addFlag == true && *rmFlag == true) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	password := *keyFlag
+	if keyEnv := os.Getenv(EnvKey); len(keyEnv) > 0 {
+		password = keyEnv
+	}
+
+	kdfSpec := *kdfFlag
+	if kdfEnv := os.Getenv(EnvKDF); len(kdfEnv) > 0 {
+		kdfSpec = kdfEnv
+	}
+	var kdf naclpipe.KDF
+	if len(kdfSpec) > 0 {
+		var err error
+		kdf, err = parseKDF(kdfSpec)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	keyPass := *keyPassFlag
+	if keyPassEnv := os.Getenv(EnvKeyPass); len(keyPassEnv) > 0 {
+		keyPass = keyPassEnv
+	}
+
+	// the old credential and, to keep it, its recipient
+	var old naclpipe.Credential
+	var slots []naclpipe.Recipient
+	if len(*identityFlag) > 0 {
+		identity, err := naclpipe.LoadIdentityFile(*identityFlag, keyPass)
+		if err != nil {
+			fatal(err)
+		}
+		old = naclpipe.IdentityCredential(identity)
+		if *addFlag == true {
+			publicKey := new([32]byte)
+			curve25519.ScalarBaseMult(publicKey, identity)
+			slots = append(slots, naclpipe.X25519Recipient(publicKey))
+		}
+	} else {
+		old = naclpipe.PasswordCredential(password)
+		if *addFlag == true {
+			slots = append(slots, naclpipe.PasswordRecipient(password, kdf))
+		}
+	}
+
+	for _, publicKey := range recipientsFlag {
+		slots = append(slots, naclpipe.X25519Recipient(publicKey))
+	}
+	if len(newPassword) > 0 {
+		slots = append(slots, naclpipe.PasswordRecipient(newPassword, kdf))
+	}
+
+	err := rekeyFile(*fileFlag, old, slots)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// rekeyFile rewraps 'path' in place or, when the new header does not fit,
+// writes a rewrapped copy next to it and renames it over 'path'.
+func rekeyFile(path string, old naclpipe.Credential, slots []naclpipe.Recipient) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = naclpipe.Rewrap(f, old, slots...)
+	if errors.Is(err, naclpipe.ErrHeaderSize) != true {
+		if err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".rekey")
+	if err != nil {
+		return err
+	}
+	// the original stays until the copy is complete
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = naclpipe.RewrapTo(tmp, f, old, slots...)
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
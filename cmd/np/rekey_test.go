@@ -0,0 +1,88 @@
+// +build go1.13
+
+// Copyright 2016-2018 (c) Eric "eau" Augé <eau+naclpipe@unix4fun.net>
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	// naclpipe package
+	"github.com/unix4fun/naclpipe"
+)
+
+// cheapKDF keeps the derivations of the tests fast.
+var cheapKDF = naclpipe.Argon2Params{CostTime: 1, CostMemory: 8 * 1024, CostThreads: 1}
+
+/*
+ *
+ *
+ *
+ *
+ * REKEY TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestRekeyPasswordStream(t *testing.T) {
+	b := []byte("rotate the leaked password")
+	dir, err := ioutil.TempDir("", "np")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret.np")
+
+	// as np -k leakedpassword < secret > secret.np
+	iobuf := new(bytes.Buffer)
+	cwr, err := passwordWriter(iobuf, naclpipe.Options{}, "leakedpassword", cheapKDF)
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+	_, err = cwr.Write(b)
+	if err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	err = cwr.Close()
+	if err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+	err = ioutil.WriteFile(path, iobuf.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// as np rekey -i secret.np -k leakedpassword -nk n3wp4ssw0rd
+	err = rekeyFile(path, naclpipe.PasswordCredential("leakedpassword"),
+		[]naclpipe.Recipient{naclpipe.PasswordRecipient("n3wp4ssw0rd", cheapKDF)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stream, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	crd, err := naclpipe.NewReader(bytes.NewReader(stream), "n3wp4ssw0rd", naclpipe.DerivateArgon2id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out, err := ioutil.ReadAll(crd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(b, out) != true {
+		t.Fatalf("data do not match")
+	}
+
+	_, err = naclpipe.NewReader(bytes.NewReader(stream), "leakedpassword", naclpipe.DerivateArgon2id)
+	if err != naclpipe.ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, naclpipe.ErrWrongKey)
+	}
+}
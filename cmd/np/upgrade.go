@@ -0,0 +1,121 @@
+// +build go1.13
+
+// Copyright 2016-2018 (c) Eric "eau" Augé <eau+naclpipe@unix4fun.net>
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	// naclpipe package
+	"github.com/unix4fun/naclpipe"
+)
+
+// upgradeUsage display the upgrade command line usage
+func upgradeUsage(fs *flag.FlagSet) func() {
+	return func() {
+		banner(os.Args[0])
+		fmt.Printf("%s upgrade [options] < old.np > new.np\n", os.Args[0])
+		fmt.Printf("re-encrypt a (legacy) stream into the current format in a single pass, the new stream can be rekeyed (see %s rekey)\n", os.Args[0])
+		fmt.Printf("--\n")
+		fmt.Printf("[environment variables]\n")
+		fmt.Printf("NPKEY: (same as -k)\n")
+		fmt.Printf("NPALG: (same as -a)\n")
+		fmt.Printf("NPNEWKEY: (same as -nk)\n")
+		fmt.Printf("NPKDF: (same as -kdf)\n")
+		fmt.Printf("--\n")
+		fs.PrintDefaults()
+	}
+}
+
+// upgrade decrypts stdin and encrypts it again to stdout, the plaintext
+// only ever exists in memory.
+func upgrade(args []string) {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	fs.Usage = upgradeUsage(fs)
+
+	// the legacy stream
+	algFlag := fs.String("a", "argon", "scrypt|argon|scrypt010 derivation of the legacy stream")
+	szFlag := fs.Int("s", defaultBufferSize, "buffer size the legacy stream was written with")
+	keyFlag := fs.String("k", defaultInsecureHardcodedKeyForLazyFolks, "key value")
+
+	// the upgraded stream
+	newAlgFlag := fs.String("na", "argon", "scrypt|argon derivation of the upgraded stream")
+	newKeyFlag := fs.String("nk", "", "new key value (default: same as -k)")
+	kdfFlag := fs.String("kdf", "", "key derivation parameters of the upgraded stream as printed by np calibrate, or @file, supersedes -na")
+
+	hlpFlag := fs.Bool("h", false, "help")
+
+	fs.Parse(args)
+
+	if len(fs.Args()) != 0 || *hlpFlag == true {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	password := *keyFlag
+	alg := *algFlag
+	newPassword := *newKeyFlag
+
+	// get from the environment
+	if keyEnv := os.Getenv(EnvKey); len(keyEnv) > 0 {
+		password = keyEnv
+	}
+
+	if keyDerivationAlgEnv := os.Getenv(EnvAlg); len(keyDerivationAlgEnv) > 0 {
+		alg = keyDerivationAlgEnv
+	}
+
+	if newKeyEnv := os.Getenv(EnvNewKey); len(newKeyEnv) > 0 {
+		newPassword = newKeyEnv
+	}
+
+	if len(newPassword) == 0 {
+		newPassword = password
+	}
+
+	kdfSpec := *kdfFlag
+	if kdfEnv := os.Getenv(EnvKDF); len(kdfEnv) > 0 {
+		kdfSpec = kdfEnv
+	}
+	var kdf naclpipe.KDF
+	if len(kdfSpec) > 0 {
+		var err error
+		kdf, err = parseKDF(kdfSpec)
+		if err != nil {
+			fatal(err)
+		}
+	} else if newDerivation := derivationFromName(*newAlgFlag); newDerivation != naclpipe.DerivateArgon2id {
+		var err error
+		kdf, err = naclpipe.DefaultKDF(newDerivation)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// Decrypt
+	crd, err := naclpipe.NewReaderSize(os.Stdin, password, derivationFromName(alg), *szFlag)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Encrypt, the upgraded stream can be rekeyed
+	cwr, err := passwordWriter(os.Stdout, naclpipe.Options{}, newPassword, kdf)
+	if err != nil {
+		fatal(err)
+	}
+
+	_, err = io.CopyBuffer(cwr, crd, make([]byte, naclpipe.DefaultChunkSize))
+	if err != nil {
+		fatal(err)
+	}
+
+	// seal the final block
+	err = cwr.Close()
+	if err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,61 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+//
+//
+// ASSOCIATED DATA
+//
+//
+
+// A stream written with Options.AssociatedData is bound to it: the context
+// extension of its header has the context tag, an HMAC-SHA256 of the
+// associated data with a subkey of the stream key, and its chunk key is
+// derived with the tag. The associated data itself is not in the stream, a
+// reader is given it (see ReaderOptions.AssociatedData) and checks the tag
+// once the key is checked, a stream moved to another context fails with
+// ErrContextMismatch before reading any chunk.
+const (
+	hkdfInfoContext  = "naclpipe context key"
+	contextTagLength = 32
+)
+
+// tagContext returns the context tag of the associated data 'ad' with the
+// derived key, nil without associated data.
+func (c *NaclPipe) tagContext(ad []byte) ([]byte, error) {
+	if len(ad) == 0 {
+		return nil, nil
+	}
+
+	var xKey [32]byte
+	defer wipe(xKey[:])
+	_, err := io.ReadFull(hkdf.New(sha256.New, c.dKey[:], c.salt, []byte(hkdfInfoContext)), xKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, xKey[:])
+	mac.Write(ad)
+	return mac.Sum(nil), nil
+}
+
+// checkContext checks the associated data 'ad' of a reader against the
+// context tag of the stream, streams without one only match no data.
+func (c *NaclPipe) checkContext(ad []byte) error {
+	tag, err := c.tagContext(ad)
+	if err != nil {
+		return err
+	}
+	if hmac.Equal(tag, c.contextTag) != true {
+		return ErrContextMismatch
+	}
+	return nil
+}
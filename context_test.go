@@ -0,0 +1,133 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"testing"
+)
+
+/*
+ *
+ *
+ *
+ *
+ * ASSOCIATED DATA TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestContextRoundTrip(t *testing.T) {
+	key := testKey(t)
+	b := []byte("tenant A backup")
+	stream := encryptStream(t, keyWriter(key), Options{ChunkSize: 1024, AssociatedData: []byte("tenantA/backup.np")}, b)
+
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(h.context) != contextTagLength || h.version != FormatV2 {
+		t.Errorf("unexpected context tag %x format %d", h.context, h.version)
+	}
+
+	decrypts(t, stream, b, func(r *bytes.Reader) (*Reader, error) {
+		return NewReaderWithKeyOptions(r, key, ReaderOptions{AssociatedData: []byte("tenantA/backup.np")})
+	})
+
+	for _, ad := range [][]byte{nil, []byte("tenantB/backup.np"), []byte("tenantA/backup.np\x00")} {
+		_, err = NewReaderWithKeyOptions(bytes.NewReader(stream), key, ReaderOptions{AssociatedData: ad})
+		if err != ErrContextMismatch {
+			t.Errorf("unexpected error: %v (vs %v) for %q", err, ErrContextMismatch, ad)
+		}
+	}
+
+	// the key is checked first
+	_, err = NewReaderWithKeyOptions(bytes.NewReader(stream), testKey(t), ReaderOptions{AssociatedData: []byte("tenantB/backup.np")})
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestContextUnbound(t *testing.T) {
+	key := testKey(t)
+	stream := encryptStream(t, keyWriter(key), Options{ChunkSize: 1024}, nil)
+
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h.context != nil || h.version != FormatV1 {
+		t.Errorf("unexpected context tag %x format %d", h.context, h.version)
+	}
+
+	_, err = NewReaderWithKeyOptions(bytes.NewReader(stream), key, ReaderOptions{AssociatedData: []byte("tenantA/backup.np")})
+	if err != ErrContextMismatch {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrContextMismatch)
+	}
+
+	legacy := legacyStream(t, nil, DerivateScrypt010, DefaultLegacyChunkSize)
+	_, err = NewReaderWithOptions(bytes.NewReader(legacy), "password", ReaderOptions{Derivation: DerivateScrypt010, AssociatedData: []byte("tenantA/backup.np")})
+	if err != ErrContextMismatch {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrContextMismatch)
+	}
+}
+
+func TestContextTampered(t *testing.T) {
+	key := testKey(t)
+	stream := encryptStream(t, keyWriter(key), Options{ChunkSize: 1024, AssociatedData: []byte("tenantA/backup.np")}, nil)
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the context tag is covered by the key check
+	stream[len(h.raw)-1] ^= 0x01
+	_, err = NewReaderWithKeyOptions(bytes.NewReader(stream), key, ReaderOptions{AssociatedData: []byte("tenantA/backup.np")})
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestContextChunkKey(t *testing.T) {
+	key := testKey(t)
+	b := make([]byte, 2048)
+
+	// the chunks of deterministic streams differ with their context
+	var chunks [][]byte
+	for _, ad := range [][]byte{[]byte("tenantA/backup.np"), []byte("tenantB/backup.np")} {
+		stream := encryptStream(t, keyWriter(key), Options{ChunkSize: 1024, Deterministic: true, AssociatedData: ad}, b)
+		chunks = append(chunks, deterministicFrames(t, stream)[1])
+	}
+	if bytes.Equal(chunks[0], chunks[1]) == true {
+		t.Errorf("chunks of different contexts match")
+	}
+}
+
+func TestContextEnvelope(t *testing.T) {
+	opsPublic, ops := testIdentity(t)
+	b := []byte("tenant A backup")
+	ad := []byte("tenantA/backup.np")
+
+	stream := encryptStream(t, envelopeWriter(PasswordRecipient("oncallpassword", cheapKDF)), Options{AssociatedData: ad}, b)
+
+	// a rewrap keeps the context without knowing it
+	out := new(bytes.Buffer)
+	err := RewrapTo(out, bytes.NewReader(stream), PasswordCredential("oncallpassword"), X25519Recipient(opsPublic))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decrypts(t, out.Bytes(), b, func(r *bytes.Reader) (*Reader, error) {
+		return NewReaderWithIdentityOptions(r, ops, ReaderOptions{AssociatedData: ad})
+	})
+
+	_, err = NewReaderWithIdentity(bytes.NewReader(out.Bytes()), ops)
+	if err != ErrContextMismatch {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrContextMismatch)
+	}
+	_, err = NewReader(bytes.NewReader(stream), "oncallpassword", DerivateArgon2id)
+	if err != ErrContextMismatch {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrContextMismatch)
+	}
+}
@@ -34,16 +34,17 @@ package naclpipe
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
-	"errors"
-	"fmt"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
 	"io"
-	"os"
+	"math"
 
-	"golang.org/x/crypto/argon2" //let's add argon2id
-	"golang.org/x/crypto/nacl/secretbox"
-	"golang.org/x/crypto/scrypt" // let's keep scrypt
-	"golang.org/x/crypto/sha3"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/hkdf"
 )
 
 //
@@ -62,54 +63,60 @@ const (
 	argonCostMemory = 256 * 1024
 	argonCostThread = 8
 
+	// every sealed chunk is prefixed by its length, the top bit of the
+	// length flags the final chunk of the stream.
+	frameHeaderLength = 4
+	frameFinalFlag    = 1 << 31
+
+	// chunk nonce: prefix || counter || final
+	noncePrefixLength = 15
+
 	// generic
 	keyLength     = 32
 	SaltLength    = 32
 	OldSaltLength = 16
-
-	// we use argon 2id by default
-	DerivateScrypt = iota
-	DerivateArgon2id
 )
 
-var (
-	// ErrUnsupported triggers for using an unsupported derivation function.
-	ErrUnsupported = errors.New("unsupported option")
-	// ErrUnsafe triggers for unsafe key derivation function.
-	ErrUnsafe = errors.New("unsafe option")
-	// ErrRead triggers on an error from the underlying io.Reader
-	ErrRead = errors.New("read error")
-	// ErrWrite triggers on an error from the underlying io.Writer
-	ErrWrite = errors.New("write error")
+// key derivations of NewWriter and of legacy streams, we use argon 2id by default
+const (
+	DerivateScrypt = iota + 1
+	DerivateArgon2id
+	// DerivateScrypt010 only decrypts legacy streams using 16 bytes salts and the old scrypt parameters.
+	DerivateScrypt010
 )
 
-// ScryptParams describes the parameters used for calling the scrypt key derivation function.
-type ScryptParams struct {
-	CostParam int
-	CostN     int
-	CostP     int
-	SaltLen   int
-	KeyLength int
-}
-
-// Argon2Params describes the parameters used for calling the Argon2id key derivation function.
-type Argon2Params struct {
-	CostTime    uint32
-	CostMemory  uint32
-	CostThreads uint8
-	KeyLength   uint32
-}
-
 // NaclPipe define the structure that handle the crypto pipe operation
 // it also holds all internal datas related to the running pipe.
 type NaclPipe struct {
-	dKey     *[32]byte // derived key
-	cntNonce *[24]byte
-	cnt      uint64 // nonce counter
-	salt     []byte // salt value mainly to avoid the writer writing before the first block is written.
-	wr       io.Writer
-	rd       io.Reader
-	params   interface{}
+	dKey        *[32]byte // derived key
+	cntNonce    *[24]byte
+	cnt         uint64 // nonce counter
+	noncePrefix []byte // random per-stream nonce prefix
+	salt        []byte // salt value mainly to avoid the writer writing before the first block is written.
+	header      []byte // serialized stream header, written before the first block.
+	check       []byte // key check of the stream header, see commits()
+	wr          io.Writer
+	rd          io.Reader
+	kdf         KDF
+	slots       []slot             // wrapped file keys of an envelope stream
+	chunkSize   uint32             // maximum plaintext size of a chunk
+	pt          []byte             // decrypted plaintext not yet returned by Read()
+	final       bool               // final chunk has been read or written
+	offset      int64              // stream offset of the next chunk to read
+	limits      ReaderOptions      // key derivation limits of the header
+	version     uint8              // header format version
+	suite       CipherSuite        // AEAD of the chunks
+	aead        cipher.AEAD        // chunk AEAD keyed with the chunk key
+	determinism bool               // synthetic chunk nonces, see Options.Deterministic
+	context     []byte             // associated data of a writer
+	contextTag  []byte             // context tag of the associated data, see tagContext()
+	metadata    Metadata           // metadata of the stream
+	sealed      []byte             // sealed metadata extension, see sealMetadata()
+	sivKey      *[32]byte          // synthetic nonce key of a deterministic stream
+	signer      ed25519.PrivateKey // signing key of a signed stream writer
+	signerKey   ed25519.PublicKey  // signer of a signed stream
+	transcript  hash.Hash          // signed data of a signed stream
+	err         error              // sticky read error, the stream is broken
 	//stdioSize uint32
 }
 
@@ -119,10 +126,21 @@ func (c *NaclPipe) initialize(d int) {
 	c.dKey = new([32]byte)
 	c.cnt = 0
 	c.salt = make([]byte, SaltLength)
+	c.noncePrefix = make([]byte, noncePrefixLength)
+	c.chunkSize = DefaultChunkSize
 
 	switch d {
+	case DerivateScrypt010:
+		c.salt = make([]byte, OldSaltLength)
+		c.kdf = ScryptParams{
+			CostParam: oldScryptCostParam,
+			CostN:     oldScryptCostN,
+			CostP:     oldScryptCostP,
+			SaltLen:   OldSaltLength,
+			KeyLength: keyLength,
+		}
 	case DerivateScrypt:
-		c.params = ScryptParams{
+		c.kdf = ScryptParams{
 			CostParam: scryptCostParam,
 			CostN:     scryptCostN,
 			CostP:     scryptCostP,
@@ -132,7 +150,7 @@ func (c *NaclPipe) initialize(d int) {
 	case DerivateArgon2id:
 		fallthrough
 	default:
-		c.params = Argon2Params{
+		c.kdf = Argon2Params{
 			CostTime:    argonCostTime,
 			CostMemory:  argonCostMemory,
 			CostThreads: argonCostThread,
@@ -160,34 +178,155 @@ func (c *NaclPipe) deriveKey(salt []byte, password string) (err error) {
 		return
 	}
 
-	switch v := c.params.(type) {
-	case ScryptParams:
-		/* let's derive a key */
-		dKey, err = scrypt.Key([]byte(password), c.salt, v.CostParam, v.CostN, v.CostP, v.KeyLength)
-		if err != nil {
-			return
-		}
+	if c.kdf == nil {
+		err = ErrUnsupported
+		return
+	}
 
-	case Argon2Params:
-		//fmt.Fprintf(os.Stderr, "ARGON DERIVATION\n")
-		dKey = argon2.IDKey([]byte(password), c.salt, v.CostTime, v.CostMemory, v.CostThreads, v.KeyLength)
-	default:
+	/* let's derive a key */
+	dKey, err = c.kdf.Derive([]byte(password), c.salt)
+	if err != nil {
+		return
+	}
+	if len(dKey) != keyLength {
+		wipe(dKey)
 		err = ErrUnsupported
 		return
 	}
 
 	copy(c.dKey[:], dKey)
+	wipe(dKey)
 	return
 }
 
-// shazam function does an SHA3 on the counter and update the counter/Nonce value generated.
-// stream operate in blocks, then each blocks will be encrypted with its nonce.
-func (c *NaclPipe) shazam() {
-	out := sha3.Sum256([]byte(fmt.Sprintf("%d", c.cnt)))
-	copy(c.cntNonce[:], out[:24])
+// HKDF labels of the subkeys of a derived key
+const (
+	hkdfInfoChunk  = "naclpipe chunk key"
+	hkdfInfoHeader = "naclpipe header key"
+)
+
+// headerCheck returns the key check of 'header', computed with a separate
+// header subkey so that the check reveals nothing about the chunk key.
+//
+// The check also commits the stream to the derived key: HMAC-SHA256 is
+// collision resistant in its key, no header checks under two keys and the
+// chunk keys are derived from the committed key. Poly1305 alone would let
+// a crafted stream open under several passwords (a partitioning oracle).
+func (c *NaclPipe) headerCheck(header []byte) ([]byte, error) {
+	var hKey [32]byte
+	defer wipe(hKey[:])
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, c.dKey[:], c.salt, []byte(hkdfInfoHeader)), hKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, hKey[:])
+	mac.Write(header)
+	return mac.Sum(nil), nil
+}
+
+// commits reports whether the derived key is the key the header check
+// commits to, key slots only open with it.
+func (c *NaclPipe) commits() bool {
+	check, err := c.headerCheck(c.header)
+	return err == nil && hmac.Equal(check, c.check)
+}
+
+// expandKey replaces the derived key by its chunk subkey and returns the key
+// check of 'header' (see headerCheck).
+func (c *NaclPipe) expandKey(header []byte) (check []byte, err error) {
+	var cKey [32]byte
+	defer wipe(cKey[:])
+
+	check, err = c.headerCheck(header)
+	if err != nil {
+		return
+	}
+	// the chunk key of a stream bound to a context depends on it
+	info := append([]byte(c.suite.hkdfInfo()), c.contextTag...)
+	_, err = io.ReadFull(hkdf.New(sha256.New, c.dKey[:], c.salt, info), cKey[:])
+	if err != nil {
+		return
+	}
+	if c.determinism {
+		c.sivKey = new([32]byte)
+		_, err = io.ReadFull(hkdf.New(sha256.New, c.dKey[:], c.salt, []byte(hkdfInfoSIV)), c.sivKey[:])
+		if err != nil {
+			return
+		}
+	}
+	copy(c.dKey[:], cKey[:])
 	return
 }
 
+// wipe zeroes the key material once the pipe is done with it.
+func (c *NaclPipe) wipe() {
+	wipe(c.dKey[:])
+	wipe(c.cntNonce[:])
+	if c.sivKey != nil {
+		wipe(c.sivKey[:])
+	}
+}
+
+// wipe zeroes a buffer.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// chunkNonce computes the nonce of the current chunk: the random per-stream
+// prefix from the header, the big endian chunk counter and a last byte that
+// authenticates whether it is the final chunk of the stream so that a
+// truncated stream cannot pass as complete.
+func (c *NaclPipe) chunkNonce(final bool) error {
+	// never wrap the counter and reuse a nonce
+	if c.cnt == math.MaxUint64 {
+		return ErrCounterOverflow
+	}
+
+	copy(c.cntNonce[:], c.noncePrefix)
+	binary.BigEndian.PutUint64(c.cntNonce[noncePrefixLength:], c.cnt)
+	c.cntNonce[23] = 0
+	if final {
+		c.cntNonce[23] = 1
+	}
+	return nil
+}
+
+// frameOverhead returns the size a sealed chunk adds to its plaintext.
+func (c *NaclPipe) frameOverhead() uint32 {
+	if c.determinism {
+		return uint32(sivLength + c.aead.Overhead())
+	}
+	return uint32(c.aead.Overhead())
+}
+
+// seal appends the sealed plaintext 'p' of the current chunk to 'dst'.
+func (c *NaclPipe) seal(dst, p []byte, final bool) ([]byte, error) {
+	err := c.chunkNonce(final)
+	if err != nil {
+		return nil, err
+	}
+	if c.determinism {
+		return c.sealSIV(dst, p, final), nil
+	}
+	return c.aead.Seal(dst, c.cntNonce[24-c.aead.NonceSize():], p, nil), nil
+}
+
+// open opens the sealed chunk 'b' of the current chunk.
+func (c *NaclPipe) open(b []byte, final bool) ([]byte, error) {
+	err := c.chunkNonce(final)
+	if err != nil {
+		return nil, err
+	}
+	if c.determinism {
+		return c.openSIV(b, final)
+	}
+	return c.aead.Open(nil, c.cntNonce[24-c.aead.NonceSize():], b, nil)
+}
+
 //
 //
 // READER
@@ -195,10 +334,28 @@ func (c *NaclPipe) shazam() {
 //
 
 func (c *NaclPipe) initReader(r io.Reader, password string) (err error) {
-	//c.salt = make([]byte, SaltLength)
+	// we read the header immediately, it tells us how to derive the key
+	err = c.useHeader(r)
+	if err != nil {
+		return
+	}
 
-	// we read the salt immediately
-	_, err = r.Read(c.salt)
+	// envelope streams may have password slots
+	if c.slots != nil {
+		_, err = c.openPasswordSlots(password)
+		if err != nil {
+			return
+		}
+		return c.checkKey(r)
+	}
+
+	// keyed streams have no password
+	if c.kdf == nil {
+		return ErrWrongKey
+	}
+
+	// the header is not authenticated yet, check its costs before paying them
+	err = c.limits.checkKDF(c.kdf)
 	if err != nil {
 		return
 	}
@@ -208,60 +365,252 @@ func (c *NaclPipe) initReader(r io.Reader, password string) (err error) {
 	if err != nil {
 		return
 	}
+	return c.checkKey(r)
+}
+
+// useHeader reads the stream header and sets up the pipe with it.
+func (c *NaclPipe) useHeader(r io.Reader) error {
+	h, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	c.header = h.raw
+	c.check = h.check
+	c.offset = int64(len(h.raw) + len(h.check))
+	c.version = h.version
+	c.suite = h.suite
+	c.determinism = h.deterministic
+	c.contextTag = h.context
+	c.sealed = h.metadata
+	c.kdf = h.kdf
+	c.chunkSize = h.chunkSize
+	c.salt = h.salt
+	c.noncePrefix = h.noncePrefix
+	c.slots = h.slots
+
+	// an untrusted signer fails before any key derivation, trusted or not
+	// the signature of a signed stream is verified
+	err = c.limits.trust(h.signer)
+	if err != nil {
+		return err
+	}
+	if h.signer != nil {
+		c.signerKey = h.signer
+		c.transcript = h.transcript()
+	}
+	return nil
+}
+
+// checkKey checks the key against the header key check and the associated
+// data of the reader against the context tag, then expands the key before
+// reading any chunk from 'r'.
+func (c *NaclPipe) checkKey(r io.Reader) error {
+	if c.commits() != true {
+		c.wipe()
+		return ErrWrongKey
+	}
+	err := c.checkContext(c.limits.AssociatedData)
+	if err != nil {
+		c.wipe()
+		return err
+	}
+	c.metadata, err = c.openMetadata(c.sealed)
+	if err != nil {
+		c.wipe()
+		return err
+	}
+
+	_, err = c.expandKey(c.header)
+	if err != nil {
+		return err
+	}
+	c.aead, err = c.suite.aead(c.dKey)
+	if err != nil {
+		return err
+	}
 	c.rd = r
-	return
+	return nil
 }
 
-// NewReader initialize an io.Reader using 'password' and the selected derivation function.
+// Reader is the decrypting io.Reader returned by NewReader, it reads both
+// the current and the legacy stream formats.
+type Reader struct {
+	rd     io.Reader // *NaclPipe or *legacyReader
+	format int
+}
+
+// Read decrypts up to len(p) bytes into p.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.rd.Read(p)
+}
+
+// Format returns the detected stream format, FormatLegacy for headerless
+// v0.2 streams or the header format version.
+func (r *Reader) Format() int {
+	return r.format
+}
+
+// NewReader initialize an io.Reader using 'password', the key derivation function
+// and its parameters are read from the stream header (or its password slots, see
+// NewEnvelopeWriter), 'derivation' is only used to decrypt legacy headerless streams.
 // Example:
-//	cryptoReader, err := naclpipe.NewReader(os.Stdin, "mypassword", naclpipe.DerivateScrypt)
+//	cryptoReader, err := naclpipe.NewReader(os.Stdin, "mypassword", naclpipe.DerivateArgon2id)
 //	if err != nil {
 //		return err
 //	}
-func NewReader(r io.Reader, password string, derivation int) (io.Reader, error) {
-	return newCryptoReader(r, password, derivation)
+func NewReader(r io.Reader, password string, derivation int) (*Reader, error) {
+	return NewReaderWithOptions(r, password, ReaderOptions{Derivation: derivation})
+}
+
+// NewReaderSize is NewReader with the chunk size of legacy headerless streams,
+// which is the buffer size they were written with (np -s).
+func NewReaderSize(r io.Reader, password string, derivation int, legacyChunkSize int) (*Reader, error) {
+	if legacyChunkSize <= 0 {
+		return nil, ErrUnsupported
+	}
+	return NewReaderWithOptions(r, password, ReaderOptions{Derivation: derivation, LegacyChunkSize: legacyChunkSize})
 }
 
 //func newCryptoReader(r io.Reader, strKey string, derivation int) (c *NaclPipe, err error) {
-func newCryptoReader(r io.Reader, password string, derivation int) (io.Reader, error) {
+func newCryptoReader(r io.Reader, password string, opts ReaderOptions) (*Reader, error) {
+	// sniff the magic, legacy streams start with the raw salt
+	magic := make([]byte, len(headerMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	r = io.MultiReader(bytes.NewReader(magic), r)
+
+	if string(magic) != headerMagic {
+		// legacy streams have no key check and commit to no key
+		if opts.RequireCommitment {
+			return nil, ErrUnsupportedVersion
+		}
+		// nor a context
+		if len(opts.AssociatedData) > 0 {
+			return nil, ErrContextMismatch
+		}
+		l := new(legacyReader)
+		l.initialize(opts.Derivation)
+		l.chunkSize = uint32(opts.LegacyChunkSize)
+
+		err = l.initReader(r, password)
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{rd: l, format: FormatLegacy}, nil
+	}
+
 	//salt := make([]byte, 16)
 	c := new(NaclPipe)
 
 	/* init values/vars */
-	c.initialize(derivation)
+	c.initialize(opts.Derivation)
+	c.limits = opts
 
 	/* let's derive a key */
-	err := c.initReader(r, password)
+	err = c.initReader(r, password)
 	if err != nil {
 		return nil, err
 	}
-	return c, nil
+	return &Reader{rd: c, format: int(c.version)}, nil
 }
 
-// Read will read the amount of
-func (c *NaclPipe) Read(p []byte) (n int, err error) {
-	if len(p) == 0 {
-		return 0, nil
+// readChunk reads the next length prefixed chunk and opens it.
+func (c *NaclPipe) readChunk() (err error) {
+	var frame [frameHeaderLength]byte
+
+	_, err = io.ReadFull(c.rd, frame[:])
+	if err != nil {
+		// the stream must end with a final chunk
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return
+	}
+
+	// a chunk cannot be bigger than what the header announced
+	size := binary.BigEndian.Uint32(frame[:])
+	final := size&frameFinalFlag != 0
+	size &^= frameFinalFlag
+	if size < c.frameOverhead() || size > c.chunkSize+c.frameOverhead() {
+		return &AuthError{Chunk: c.cnt, Offset: c.offset}
+	}
+
+	b := make([]byte, size)
+	_, err = io.ReadFull(c.rd, b)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return
+	}
+	if c.transcript != nil {
+		c.transcript.Write(frame[:])
+		c.transcript.Write(b)
 	}
 
-	c.shazam()
+	// a forged final flag changes the nonce and fails to open
+	pt, err := c.open(b, final)
+	if err == ErrCounterOverflow {
+		return
+	}
+	if err != nil {
+		// the key was checked with the header, this chunk is corrupted
+		return &AuthError{Chunk: c.cnt, Offset: c.offset}
+	}
+	c.cnt++
+	c.offset += frameHeaderLength + int64(size)
 
-	//b := make([]byte, len(p))
-	b := make([]byte, len(p)+secretbox.Overhead)
+	// the last plaintext of a signed stream waits for its signature
+	if final && c.transcript != nil {
+		err = c.verifySignature()
+		if err != nil {
+			wipe(pt)
+			return
+		}
+	}
+	if final {
+		// nothing may follow the final chunk, not even its plaintext is
+		// returned otherwise
+		var trailing [1]byte
+		if n, _ := io.ReadFull(c.rd, trailing[:]); n != 0 {
+			wipe(pt)
+			return ErrTrailingData
+		}
+		c.final = true
+		c.wipe()
+	}
+	c.pt = pt
+	return
+}
 
-	//n, err = c.rd.Read(b)
-	n, err = io.ReadFull(c.rd, b)
-	if err != nil && err != io.ErrUnexpectedEOF {
-		return n, err
+// Read decrypts up to len(p) bytes into p, chunks are buffered internally
+// so any buffer size can be used. Once a chunk fails every later Read
+// returns the same error.
+func (c *NaclPipe) Read(p []byte) (n int, err error) {
+	switch {
+	case c.err != nil:
+		return 0, c.err
+	case len(p) == 0:
+		return 0, nil
 	}
 
-	pt, res := secretbox.Open(nil, b[:n], c.cntNonce, c.dKey)
-	if res == true {
-		copy(p, pt)
-		c.cnt++
-		return len(pt), nil
+	// empty chunks are valid, skip them
+	for len(c.pt) == 0 {
+		if c.final {
+			return 0, io.EOF
+		}
+		err = c.readChunk()
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
 	}
-	return 0, ErrRead
+
+	n = copy(p, c.pt)
+	c.pt = c.pt[n:]
+	return n, nil
 }
 
 //
@@ -270,12 +619,6 @@ func (c *NaclPipe) Read(p []byte) (n int, err error) {
 //
 //
 
-func (c *NaclPipe) writeSalt() (err error) {
-	n, err := c.wr.Write(c.salt)
-	fmt.Printf("writeSalt(salt: %d bytes): n: %d err: %v\n", len(c.salt), n, err)
-	return
-}
-
 func (c *NaclPipe) initWriter(w io.Writer, password string) (err error) {
 	//c.salt = make([]byte, scryptSaltLen)
 
@@ -285,8 +628,52 @@ func (c *NaclPipe) initWriter(w io.Writer, password string) (err error) {
 		return
 	}
 
-	/* let's derive a key */
-	err = c.deriveKey(c.salt, password)
+	// and the nonce prefix
+	_, err = rand.Read(c.noncePrefix)
+	if err != nil {
+		return
+	}
+
+	// unless the stream is deterministic, keyed streams only
+	if c.determinism {
+		c.deterministicSalt()
+	}
+
+	/* let's derive a key, keyed streams already have it */
+	if c.kdf != nil {
+		err = c.deriveKey(c.salt, password)
+		if err != nil {
+			return
+		}
+	}
+
+	if c.signer != nil {
+		c.signerKey = c.signer.Public().(ed25519.PublicKey)
+	}
+	c.contextTag, err = c.tagContext(c.context)
+	if err != nil {
+		return
+	}
+	c.sealed, err = c.sealMetadata(c.metadata)
+	if err != nil {
+		return
+	}
+	h := c.newHeader()
+	c.header, err = h.marshal()
+	if err != nil {
+		return
+	}
+	if c.signer != nil {
+		c.transcript = h.transcript()
+	}
+
+	check, err := c.expandKey(c.header)
+	if err != nil {
+		return
+	}
+	c.header = append(c.header, check...)
+
+	c.aead, err = c.suite.aead(c.dKey)
 	if err != nil {
 		return
 	}
@@ -295,54 +682,202 @@ func (c *NaclPipe) initWriter(w io.Writer, password string) (err error) {
 	return
 }
 
-// NewWriter initialize an io.Writer using 'password' and the selected derivation function.
+// newHeader returns the header of the pipe, in the oldest format version
+// that has room for its extensions.
+func (c *NaclPipe) newHeader() *header {
+	h := &header{
+		version:       FormatV1,
+		kdf:           c.kdf,
+		slots:         c.slots,
+		chunkSize:     c.chunkSize,
+		salt:          c.salt,
+		noncePrefix:   c.noncePrefix,
+		suite:         c.suite,
+		deterministic: c.determinism,
+		context:       c.contextTag,
+		metadata:      c.sealed,
+		signer:        c.signerKey,
+	}
+	if len(h.marshalExtensions()) > 0 {
+		h.version = FormatV2
+	}
+	return h
+}
+
+// Writer is the encrypting io.WriteCloser returned by NewWriter, it buffers
+// the data and seals it in chunks of the header chunk size.
+type Writer struct {
+	c   *NaclPipe
+	buf []byte // plaintext not sealed yet
+	err error  // sticky error, the stream is broken
+}
+
+// NewWriter initialize an io.WriteCloser using 'password' and the selected derivation function,
+// Close() must be called to terminate the stream.
 // Example:
 //	cryptoWriter, err := naclpipe.NewWriter(os.Stdout, "mypassword", naclpipe.DerivateScrypt)
 //	if err != nil {
 //		return err
 //	}
-func NewWriter(w io.Writer, password string, derivation int) (io.Writer, error) {
-	return newCryptoWriter(w, password, derivation)
+//	defer cryptoWriter.Close()
+func NewWriter(w io.Writer, password string, derivation int) (*Writer, error) {
+	// legacy derivations only decrypt
+	if derivation == DerivateScrypt010 {
+		return nil, ErrUnsupported
+	}
+	return newCryptoWriter(w, password, derivation, Options{})
 }
 
 //func newCryptoWriter(w io.Writer, strKey string, derivation int) (c *NaclPipe, err error) {
-func newCryptoWriter(w io.Writer, password string, derivation int) (io.Writer, error) {
+func newCryptoWriter(w io.Writer, password string, derivation int, opts Options) (*Writer, error) {
 	//salt := make([]byte, 16)
 	c := new(NaclPipe)
 
 	/* init values/vars */
 	c.initialize(derivation)
 
+	// options supersede the derivation defaults, a password stream is
+	// never deterministic
+	if opts.Deterministic {
+		return nil, ErrUnsupported
+	}
+	if opts.KDF != nil {
+		if _, ok := lookupKDF(opts.KDF.ID()); ok != true {
+			return nil, ErrUnsupported
+		}
+		// a default reader would refuse the stream
+		if err := (ReaderOptions{}).checkKDF(opts.KDF); err != nil {
+			return nil, err
+		}
+		c.kdf = opts.KDF
+	}
+	err := c.setOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	/* let's derive a key */
-	err := c.initWriter(w, password)
+	err = c.initWriter(w, password)
 	if err != nil {
 		return nil, err
 	}
 
-	return c, nil
+	return &Writer{c: c, buf: make([]byte, 0, c.chunkSize)}, nil
 }
 
-// SHA3 the counter use it as nonce
-func (c *NaclPipe) Write(p []byte) (n int, err error) {
-	c.shazam()
-
+// writeChunk seals 'p' and writes it prefixed by its length.
+func (c *NaclPipe) writeChunk(p []byte, final bool) (err error) {
 	if c.cnt == 0 {
-		n, err = c.wr.Write(c.salt)
+		err = c.write(c.header)
 		if err != nil {
 			return
 		}
 	}
 
 	// Seal
-	ct := secretbox.Seal(nil, p, c.cntNonce, c.dKey)
+	ct := make([]byte, frameHeaderLength, frameHeaderLength+len(p)+int(c.frameOverhead()))
+	ct, err = c.seal(ct, p, final)
+	if err != nil {
+		return
+	}
+	size := uint32(len(ct) - frameHeaderLength)
+	if final {
+		size |= frameFinalFlag
+	}
+	binary.BigEndian.PutUint32(ct, size)
 	c.cnt++
 
 	// now Write()
-	n, err = c.wr.Write(ct)
-	if err != nil || n != len(ct) {
-		fmt.Fprintf(os.Stderr, "we should write %d but wrote %d (err:%v)\n", len(ct), n, err)
+	err = c.write(ct)
+	if err != nil || c.transcript == nil {
+		return
 	}
 
-	n = len(p)
+	// a signed stream ends with its signature
+	c.transcript.Write(ct)
+	if final {
+		err = c.write(c.sign())
+	}
 	return
 }
+
+// write writes 'b' to the underlying io.Writer, a short write is an error.
+func (c *NaclPipe) write(b []byte) error {
+	n, err := c.wr.Write(b)
+	if err == nil && n != len(b) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return &WriteError{Err: err}
+	}
+	return nil
+}
+
+// seal seals the buffered data, any failure breaks the stream for good.
+func (w *Writer) seal(final bool) error {
+	err := w.c.writeChunk(w.buf, final)
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// Write buffers 'p' and seals it in chunks of the header chunk size, the
+// chunk boundaries do not depend on the size of the writes.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	switch {
+	case w.err != nil:
+		return 0, w.err
+	case w.c.final:
+		return 0, ErrWrite
+	}
+
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data comes in,
+		// it might be the final one.
+		if len(w.buf) == cap(w.buf) {
+			err = w.seal(false)
+			if err != nil {
+				return
+			}
+		}
+
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+// Flush seals the buffered data in a chunk of its own, the reader then
+// gets it without waiting for a full chunk. Frequent flushes cost space.
+func (w *Writer) Flush() error {
+	switch {
+	case w.err != nil:
+		return w.err
+	case w.c.final:
+		return ErrWrite
+	case len(w.buf) == 0:
+		return nil
+	}
+	return w.seal(false)
+}
+
+// Close seals the buffered data as the final chunk, the stream is incomplete
+// and will not decrypt without it, then wipes the key material.
+// Close does not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.c.final {
+		return w.err
+	}
+	w.c.final = true
+
+	if w.err == nil {
+		w.seal(true)
+	}
+	wipe(w.buf[:cap(w.buf)])
+	w.c.wipe()
+	return w.err
+}
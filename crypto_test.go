@@ -8,9 +8,13 @@ import (
 	"crypto/sha256"
 	"errors"
 	"io"
+	"io/ioutil"
+	"math"
 	"testing"
 
 	mrnd "math/rand"
+
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 const (
@@ -48,11 +52,23 @@ func (r *TestReaderFailIO) Read(b []byte) (n int, err error) {
 type TestWriter struct {
 }
 
+type TestWriterShort struct {
+	n int
+}
+
 func (w *TestWriter) Write(b []byte) (n int, err error) {
 	//fmt.Printf("TestWriterLog buf: %d bytes\n", len(b))
 	return 0, errWriter
 }
 
+func (w *TestWriterShort) Write(b []byte) (n int, err error) {
+	w.n += len(b)
+	if w.n > 64 {
+		return len(b) - 1, nil
+	}
+	return len(b), nil
+}
+
 /*
  *
  *
@@ -71,7 +87,7 @@ func TestNaclpipeInitialize(t *testing.T) {
 	// argon derivation
 	c.initialize(DerivateArgon2id)
 
-	switch v := c.params.(type) {
+	switch v := c.kdf.(type) {
 	case Argon2Params:
 		// all good
 	default:
@@ -81,24 +97,26 @@ func TestNaclpipeInitialize(t *testing.T) {
 	// scrypt new derivation
 	c.initialize(DerivateScrypt)
 
-	switch v := c.params.(type) {
+	switch v := c.kdf.(type) {
 	case ScryptParams:
 		// all good
 	default:
 		t.Errorf("wrong expected Scrypt(%d) vs %T", DerivateScrypt, v)
 	}
 
-	// scrypt new derivation
-	/*
-		c.initialize(DerivateScrypt010)
-
-		switch v := c.params.(type) {
-		case ScryptParams:
-			// all good
-		default:
-			t.Errorf("wrong expected Scrypt010(%d) vs %T", DerivateScrypt010, v)
-		}
-	*/
+	// scrypt legacy derivation
+	c.initialize(DerivateScrypt010)
+
+	switch v := c.kdf.(type) {
+	case ScryptParams:
+		// all good
+	default:
+		t.Errorf("wrong expected Scrypt010(%d) vs %T", DerivateScrypt010, v)
+	}
+
+	if len(c.salt) != OldSaltLength {
+		t.Errorf("wrong expected Scrypt010 salt length %d vs %d", OldSaltLength, len(c.salt))
+	}
 
 }
 
@@ -205,11 +223,11 @@ func TestNaclDeriveKeyOK(t *testing.T) {
  */
 
 func TestInitReaderZeroSalt(t *testing.T) {
-	tr := &TestReaderZero{}
-
 	c := new(NaclPipe)
 	c.initialize(DerivateArgon2id)
 
+	tr := testStream(t, c.kdf, make([]byte, SaltLength), &TestReaderZero{})
+
 	err := c.initReader(tr, "password")
 	switch err {
 	case ErrUnsafe:
@@ -224,7 +242,7 @@ func TestInitReaderShortPass(t *testing.T) {
 	c := new(NaclPipe)
 	c.initialize(DerivateArgon2id)
 
-	err := c.initReader(rand.Reader, "pass")
+	err := c.initReader(testStream(t, c.kdf, randomSalt(t), rand.Reader), "pass")
 	switch err {
 	case ErrUnsafe:
 	default:
@@ -275,7 +293,10 @@ func TestInitReaderFail(t *testing.T) {
  */
 
 func TestNewReaderZeroSalt(t *testing.T) {
-	tr := &TestReaderZero{}
+	c := new(NaclPipe)
+	c.initialize(DerivateScrypt)
+
+	tr := testStream(t, c.kdf, make([]byte, SaltLength), &TestReaderZero{})
 
 	_, err := NewReader(tr, "password", DerivateScrypt)
 	switch err {
@@ -287,7 +308,10 @@ func TestNewReaderZeroSalt(t *testing.T) {
 }
 
 func TestNewReaderShortPass(t *testing.T) {
-	_, err := NewReader(rand.Reader, "pass", DerivateScrypt)
+	c := new(NaclPipe)
+	c.initialize(DerivateScrypt)
+
+	_, err := NewReader(testStream(t, c.kdf, randomSalt(t), rand.Reader), "pass", DerivateScrypt)
 	switch err {
 	case ErrUnsafe:
 	default:
@@ -327,21 +351,27 @@ func TestNewWriterFailWriter(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
+	// buffered until the chunk is sealed
 	buf := []byte("testtesttest")
 	n, err := cw.Write(buf)
-	if err != errWriter {
+	if err != nil || n != len(buf) {
 		t.Fatalf("unexpected error: %d/%v", n, err)
 	}
 
+	err = cw.Close()
+	if we, ok := err.(*WriteError); ok != true || we.Err != errWriter {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
 }
 
 func TestNewReaderDefaultDerivation(t *testing.T) {
-	cr, err := NewReader(rand.Reader, "password", 233)
+	cr, err := NewReader(testStream(t, cheapKDF, randomSalt(t), rand.Reader), "password", 233)
 	switch err {
 	case nil:
-		c, ok := cr.(*NaclPipe)
+		c, ok := cr.rd.(*NaclPipe)
 		if ok {
-			switch v := c.params.(type) {
+			switch v := c.kdf.(type) {
 			case Argon2Params:
 				// all good
 			default:
@@ -357,12 +387,12 @@ func TestNewReaderDefaultDerivation(t *testing.T) {
 }
 
 func TestNewReaderValidDerivationScrypt(t *testing.T) {
-	cr, err := NewReader(rand.Reader, "password", DerivateScrypt)
+	cr, err := NewReader(testStream(t, cheapScrypt, randomSalt(t), rand.Reader), "password", DerivateScrypt)
 	switch err {
 	case nil:
-		c, ok := cr.(*NaclPipe)
+		c, ok := cr.rd.(*NaclPipe)
 		if ok {
-			switch v := c.params.(type) {
+			switch v := c.kdf.(type) {
 			case ScryptParams:
 				// all good
 			default:
@@ -378,12 +408,12 @@ func TestNewReaderValidDerivationScrypt(t *testing.T) {
 }
 
 func TestNewReaderValidDerivationArgon(t *testing.T) {
-	cr, err := NewReader(rand.Reader, "password", DerivateArgon2id)
+	cr, err := NewReader(testStream(t, cheapKDF, randomSalt(t), rand.Reader), "password", DerivateArgon2id)
 	switch err {
 	case nil:
-		c, ok := cr.(*NaclPipe)
+		c, ok := cr.rd.(*NaclPipe)
 		if ok {
-			switch v := c.params.(type) {
+			switch v := c.kdf.(type) {
 			case Argon2Params:
 				// all good
 			default:
@@ -398,18 +428,39 @@ func TestNewReaderValidDerivationArgon(t *testing.T) {
 
 }
 
-/*
+func TestNewReaderHeaderDerivation(t *testing.T) {
+	// the header says scrypt, the derivation argument is ignored
+	cr, err := NewReader(testStream(t, cheapScrypt, randomSalt(t), rand.Reader), "password", DerivateArgon2id)
+	switch err {
+	case nil:
+		c, ok := cr.rd.(*NaclPipe)
+		if ok {
+			switch v := c.kdf.(type) {
+			case ScryptParams:
+				// all good
+			default:
+				t.Errorf("wrong expected DerivateScrypt(%d) vs %T", DerivateScrypt, v)
+			}
+		} else {
+			t.Errorf("wrong naclpipe structure %T", cr)
+		}
+	default:
+		t.Errorf("no error but: %v", err)
+	}
+
+}
+
 func TestNewReaderValidDerivationScrypt010(t *testing.T) {
 	cr, err := NewReader(rand.Reader, "password", DerivateScrypt010)
 	switch err {
 	case nil:
-		c, ok := cr.(*NaclPipe)
+		c, ok := cr.rd.(*legacyReader)
 		if ok {
-			switch v := c.params.(type) {
+			switch v := c.kdf.(type) {
 			case ScryptParams:
 				// all good
 				if v.CostParam != oldScryptCostParam {
-					t.Errorf("wrong expected DerivateScrypt010 params(%d) vs %T", oldScryptCostParam, v.CostParam)
+					t.Errorf("wrong expected DerivateScrypt010 params(%d) vs %d", oldScryptCostParam, v.CostParam)
 				}
 			default:
 				t.Errorf("wrong expected DerivateScrypt(%d) vs %T", DerivateScrypt010, v)
@@ -422,7 +473,6 @@ func TestNewReaderValidDerivationScrypt010(t *testing.T) {
 	}
 
 }
-*/
 
 /*
  *
@@ -439,8 +489,7 @@ func TestNewReaderValidDerivationScrypt010(t *testing.T) {
 
 func TestReadZeroLength(t *testing.T) {
 	b := make([]byte, 0)
-
-	cr, err := NewReader(rand.Reader, "password", DerivateArgon2id)
+	cr, err := NewReader(testStream(t, cheapKDF, randomSalt(t), rand.Reader), "password", DerivateArgon2id)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -457,15 +506,16 @@ func TestReadZeroLength(t *testing.T) {
 
 func TestReadInvalidReaderByte(t *testing.T) {
 	b := make([]byte, 1)
-
-	cr, err := NewReader(rand.Reader, "password", DerivateArgon2id)
+	// an invalid chunk length
+	body := bytes.NewReader(bytes.Repeat([]byte{0xff}, 64))
+	cr, err := NewReader(testStream(t, cheapKDF, randomSalt(t), body), "password", DerivateArgon2id)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
 	n, err := cr.Read(b)
-	if err != ErrRead {
-		t.Errorf("unexpected error: %v (vs nil)", err)
+	if ae, ok := err.(*AuthError); ok != true || ae.Chunk != 0 {
+		t.Errorf("unexpected error: %v (vs AuthError)", err)
 	}
 
 	if n != 0 {
@@ -477,8 +527,9 @@ func TestReadUnexpectedEndIo(t *testing.T) {
 	tr := &TestReaderFailIO{}
 	//b := make([]byte, 32)
 
+	// a zeroed stream has no header, it is a legacy stream with a zero salt
 	cr, err := NewReader(tr, "password", DerivateArgon2id)
-	if err != io.ErrUnexpectedEOF {
+	if err != ErrUnsafe {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
@@ -518,6 +569,11 @@ func TestReadWrite(t *testing.T) {
 			t.Fatalf("crypto writer (%d bytes) error: %v", n, err)
 		}
 
+		err = cw.Close()
+		if err != nil {
+			t.Fatalf("crypto writer close error: %v", err)
+		}
+
 		// CREATE CRYPTO READER
 		cr, err := NewReader(iobuf, "password", DerivateArgon2id)
 		if err != nil {
@@ -525,8 +581,8 @@ func TestReadWrite(t *testing.T) {
 		}
 
 		// READ CRYPTED DATA
-		n, err = cr.Read(c)
-		if err != nil || n == 0 {
+		n, err = io.ReadFull(cr, c)
+		if err != nil || n != size {
 			t.Fatalf("unexpected error: %v (vs nil) n: %d", err, n)
 		}
 
@@ -543,3 +599,582 @@ func TestReadWrite(t *testing.T) {
 	}
 
 }
+
+func TestReadWriteChunks(t *testing.T) {
+	b := make([]byte, 3*DefaultChunkSize+123)
+	iobuf := new(bytes.Buffer)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+
+	cw, err := NewWriterWithOptions(iobuf, "password", Options{KDF: cheapScrypt})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	// write sizes unrelated to the chunk size
+	for i, sz := 0, 1; i < len(b); i, sz = i+sz, sz*7 {
+		if i+sz > len(b) {
+			sz = len(b) - i
+		}
+		n, err := cw.Write(b[i : i+sz])
+		if err != nil || n != sz {
+			t.Fatalf("crypto writer (%d/%d bytes) error: %v", n, sz, err)
+		}
+	}
+
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+
+	cr, err := NewReader(iobuf, "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	// io.Copy uses its own buffer size
+	out := new(bytes.Buffer)
+	n, err := io.Copy(out, cr)
+	if err != nil || n != int64(len(b)) {
+		t.Fatalf("unexpected error: %v (vs nil) n: %d", err, n)
+	}
+
+	if bytes.Equal(b, out.Bytes()) != true {
+		t.Fatalf("data do not match")
+	}
+}
+
+func TestReadBadChunkLength(t *testing.T) {
+	// the length prefix is bigger than the header chunk size
+	frame := []byte{0xff, 0xff, 0xff, 0xff}
+	cr, err := NewReader(testStream(t, cheapScrypt, randomSalt(t), bytes.NewReader(frame)), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n, err := cr.Read(make([]byte, 16))
+	ae, ok := err.(*AuthError)
+	if ok != true || n != 0 {
+		t.Fatalf("unexpected error: %v (vs AuthError) n: %d", err, n)
+	}
+
+	if ae.Chunk != 0 || ae.Offset != int64(len(cr.rd.(*NaclPipe).header)+headerCheckLength) {
+		t.Errorf("unexpected chunk %d offset %d", ae.Chunk, ae.Offset)
+	}
+}
+
+// cheap key derivations at the reader floor, fast enough for many streams
+// and password slots, TestReadWrite derives with the default costs
+var (
+	cheapKDF    = Argon2Params{CostTime: 1, CostMemory: 8 * 1024, CostThreads: 1, KeyLength: keyLength}
+	cheapScrypt = ScryptParams{CostParam: 8192, CostN: 8, CostP: 1, SaltLen: SaltLength, KeyLength: keyLength}
+)
+
+// writeStream writes 'b' to 'cw' and closes it, the stream is in the
+// io.Writer 'cw' was created with.
+func writeStream(t *testing.T, cw *Writer, b []byte) {
+	_, err := cw.Write(b)
+	if err != nil {
+		t.Fatalf("crypto writer error: %v", err)
+	}
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+}
+
+// writerFunc is a writer constructor taking Options, see passwordWriter,
+// keyWriter and envelopeWriter.
+type writerFunc func(w io.Writer, opts Options) (*Writer, error)
+
+// encryptStream encrypts 'b' with the writer 'newWriter' returns for 'opts'.
+func encryptStream(t *testing.T, newWriter writerFunc, opts Options, b []byte) []byte {
+	iobuf := new(bytes.Buffer)
+
+	cw, err := newWriter(iobuf, opts)
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+	writeStream(t, cw, b)
+	return iobuf.Bytes()
+}
+
+// passwordWriter writes the streams of 'password'.
+func passwordWriter(password string) writerFunc {
+	return func(w io.Writer, opts Options) (*Writer, error) {
+		return NewWriterWithOptions(w, password, opts)
+	}
+}
+
+// keyWriter writes the streams of the master 'key'.
+func keyWriter(key *[32]byte) writerFunc {
+	return func(w io.Writer, opts Options) (*Writer, error) {
+		return NewWriterWithKeyOptions(w, key, opts)
+	}
+}
+
+// envelopeWriter writes the envelope streams of 'recipients'.
+func envelopeWriter(recipients ...Recipient) writerFunc {
+	return func(w io.Writer, opts Options) (*Writer, error) {
+		return NewEnvelopeWriterWithOptions(w, opts, recipients...)
+	}
+}
+
+// testChunks encrypts 'nchunks' full chunks and returns the stream and
+// the offset of each chunk frame.
+func testChunks(t *testing.T, nchunks int) ([]byte, []int) {
+	iobuf := new(bytes.Buffer)
+
+	cw, err := NewWriterWithOptions(iobuf, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	var offsets []int
+	b := make([]byte, DefaultChunkSize)
+	for i := 0; i < nchunks; i++ {
+		if i > 0 {
+			offsets = append(offsets, iobuf.Len())
+		}
+		_, err = cw.Write(b)
+		if err != nil {
+			t.Fatalf("crypto writer error: %v", err)
+		}
+		err = cw.Flush()
+		if err != nil {
+			t.Fatalf("crypto writer flush error: %v", err)
+		}
+		if i == 0 {
+			// the header is written with the first chunk
+			offsets = append(offsets, iobuf.Len()-DefaultChunkSize-secretbox.Overhead-frameHeaderLength)
+		}
+	}
+
+	offsets = append(offsets, iobuf.Len())
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+	return iobuf.Bytes(), offsets
+}
+
+func TestReadTruncated(t *testing.T) {
+	stream, offsets := testChunks(t, 3)
+
+	// drop the final chunk, then cut in the middle of a chunk
+	for _, end := range []int{offsets[3], offsets[2] + 10} {
+		cr, err := NewReader(bytes.NewReader(stream[:end]), "password", DerivateScrypt)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+
+		_, err = io.Copy(ioutil.Discard, cr)
+		if err != ErrTruncated {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrTruncated)
+		}
+	}
+}
+
+func TestReadForgedFinal(t *testing.T) {
+	stream, offsets := testChunks(t, 3)
+
+	// flag the second chunk as final and drop the rest
+	forged := append([]byte(nil), stream[:offsets[2]]...)
+	forged[offsets[1]] |= 0x80
+
+	cr, err := NewReader(bytes.NewReader(forged), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	_, err = io.Copy(ioutil.Discard, cr)
+	if ae, ok := err.(*AuthError); ok != true || ae.Chunk != 1 || ae.Offset != int64(offsets[1]) {
+		t.Errorf("unexpected error: %v (vs AuthError)", err)
+	}
+}
+
+func TestReadReordered(t *testing.T) {
+	stream, offsets := testChunks(t, 3)
+
+	// swap the second and third chunks
+	swapped := append([]byte(nil), stream[:offsets[1]]...)
+	swapped = append(swapped, stream[offsets[2]:offsets[3]]...)
+	swapped = append(swapped, stream[offsets[1]:offsets[2]]...)
+	swapped = append(swapped, stream[offsets[3]:]...)
+
+	cr, err := NewReader(bytes.NewReader(swapped), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	_, err = io.Copy(ioutil.Discard, cr)
+	if ae, ok := err.(*AuthError); ok != true || ae.Chunk != 1 || ae.Offset != int64(offsets[1]) {
+		t.Errorf("unexpected error: %v (vs AuthError)", err)
+	}
+}
+
+func TestReadTrailingData(t *testing.T) {
+	stream, _ := testChunks(t, 1)
+
+	cr, err := NewReader(io.MultiReader(bytes.NewReader(stream), rand.Reader), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	_, err = io.Copy(ioutil.Discard, cr)
+	if err != ErrTrailingData {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrTrailingData)
+	}
+}
+
+func TestReadTrailingDataFinal(t *testing.T) {
+	iobuf := new(bytes.Buffer)
+	cw, err := NewWriterWithOptions(iobuf, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+	writeStream(t, cw, []byte("only in the final chunk"))
+	iobuf.WriteByte(0)
+
+	cr, err := NewReader(iobuf, "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	// the final plaintext is never released, the error sticks
+	for i := 0; i < 2; i++ {
+		n, err := cr.Read(make([]byte, 64))
+		if err != ErrTrailingData || n != 0 {
+			t.Errorf("unexpected error: %v (vs %v) n: %d", err, ErrTrailingData, n)
+		}
+	}
+}
+
+func TestReadCorrupted(t *testing.T) {
+	stream, offsets := testChunks(t, 3)
+
+	corrupted := append([]byte(nil), stream...)
+	corrupted[offsets[2]+100] ^= 0x01
+
+	cr, err := NewReader(bytes.NewReader(corrupted), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	n, err := io.Copy(ioutil.Discard, cr)
+	if ae, ok := err.(*AuthError); ok != true || ae.Chunk != 2 || ae.Offset != int64(offsets[2]) {
+		t.Errorf("unexpected error: %v (vs AuthError)", err)
+	}
+
+	// the first two chunks made it
+	if n != 2*DefaultChunkSize {
+		t.Errorf("unexpected read %d bytes (vs %d)", n, 2*DefaultChunkSize)
+	}
+}
+
+func TestReadErrorSticky(t *testing.T) {
+	stream, offsets := testChunks(t, 3)
+
+	corrupted := append([]byte(nil), stream...)
+	corrupted[offsets[1]+100] ^= 0x01
+	length := append([]byte(nil), stream...)
+	copy(length[offsets[1]:], []byte{0x7f, 0xff, 0xff, 0xff})
+
+	for _, b := range [][]byte{corrupted, length, stream[:offsets[3]], stream[:offsets[2]+10]} {
+		cr, err := NewReader(bytes.NewReader(b), "password", DerivateScrypt)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+		_, err = io.Copy(ioutil.Discard, cr)
+		if err == nil {
+			t.Fatalf("unexpected error: %v (vs typed error)", err)
+		}
+
+		// no more frames are consumed, the same error is returned
+		for i := 0; i < 3; i++ {
+			n, again := cr.Read(make([]byte, DefaultChunkSize))
+			if again != err || n != 0 {
+				t.Errorf("unexpected error: %v (vs %v) n: %d", again, err, n)
+			}
+		}
+	}
+}
+
+func TestReadWrongKey(t *testing.T) {
+	stream, _ := testChunks(t, 1)
+
+	// the key check fails before any chunk is read
+	_, err := NewReader(bytes.NewReader(stream), "wrongpassword", DerivateScrypt)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestReadWrongKeyEmpty(t *testing.T) {
+	iobuf := new(bytes.Buffer)
+
+	cw, err := NewWriterWithOptions(iobuf, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+
+	_, err = NewReader(iobuf, "wrongpassword", DerivateScrypt)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestReadTamperedHeader(t *testing.T) {
+	stream, offsets := testChunks(t, 1)
+
+	// the nonce prefix is right before the key check
+	stream[offsets[0]-headerCheckLength-1] ^= 0x01
+
+	_, err := NewReader(bytes.NewReader(stream), "password", DerivateScrypt)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestReadCorruptedFirstChunk(t *testing.T) {
+	stream, offsets := testChunks(t, 2)
+	stream[offsets[0]+frameHeaderLength] ^= 0x01
+
+	cr, err := NewReader(bytes.NewReader(stream), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	// with the key checked, a first chunk failing to open is corrupted
+	_, err = io.Copy(ioutil.Discard, cr)
+	if ae, ok := err.(*AuthError); ok != true || ae.Chunk != 0 || ae.Offset != int64(offsets[0]) {
+		t.Errorf("unexpected error: %v (vs AuthError)", err)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	cw, err := NewWriterWithOptions(ioutil.Discard, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+
+	_, err = cw.Write([]byte("testtesttest"))
+	if err != ErrWrite {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrite)
+	}
+}
+
+func TestChunkNonce(t *testing.T) {
+	c := new(NaclPipe)
+	c.initialize(DerivateScrypt)
+	copy(c.noncePrefix, "0123456789abcde")
+	c.cnt = 0x0102030405060708
+
+	err := c.chunkNonce(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "0123456789abcde\x01\x02\x03\x04\x05\x06\x07\x08\x01"
+	if string(c.cntNonce[:]) != expected {
+		t.Errorf("unexpected nonce %x vs %x", c.cntNonce[:], expected)
+	}
+}
+
+func TestWriteCounterOverflow(t *testing.T) {
+	cw, err := NewWriterWithOptions(ioutil.Discard, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	cw.c.cnt = math.MaxUint64
+
+	_, err = cw.Write([]byte("testtesttest"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = cw.Close()
+	if err != ErrCounterOverflow {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrCounterOverflow)
+	}
+}
+
+func TestWriterBuffering(t *testing.T) {
+	iobuf := new(bytes.Buffer)
+	size := 2 * DefaultChunkSize
+
+	cw, err := NewWriterWithOptions(iobuf, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	// small writes still fill whole chunks
+	b := make([]byte, 16)
+	for i := 0; i < size/len(b); i++ {
+		_, err = cw.Write(b)
+		if err != nil {
+			t.Fatalf("crypto writer error: %v", err)
+		}
+	}
+
+	// the last full chunk waits for more data
+	if iobuf.Len() != len(cw.c.header)+DefaultChunkSize+secretbox.Overhead+frameHeaderLength {
+		t.Errorf("unexpected stream length %d before close", iobuf.Len())
+	}
+
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+
+	// two chunks, the final one is full
+	if iobuf.Len() != len(cw.c.header)+size+2*(secretbox.Overhead+frameHeaderLength) {
+		t.Errorf("unexpected stream length %d", iobuf.Len())
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	iobuf := new(bytes.Buffer)
+	b := []byte("testtesttest")
+
+	cw, err := NewWriterWithOptions(iobuf, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	_, err = cw.Write(b)
+	if err != nil {
+		t.Fatalf("crypto writer error: %v", err)
+	}
+
+	err = cw.Flush()
+	if err != nil {
+		t.Fatalf("crypto writer flush error: %v", err)
+	}
+
+	// the flushed data is readable before the stream is closed
+	cr, err := NewReader(iobuf, "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	c := make([]byte, 64)
+	n, err := cr.Read(c)
+	if err != nil || bytes.Equal(c[:n], b) != true {
+		t.Errorf("unexpected read: %q %v", c[:n], err)
+	}
+}
+
+func TestWriterEmpty(t *testing.T) {
+	iobuf := new(bytes.Buffer)
+
+	cw, err := NewWriterWithOptions(iobuf, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+
+	cr, err := NewReader(iobuf, "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	n, err := cr.Read(make([]byte, 16))
+	if err != io.EOF || n != 0 {
+		t.Errorf("unexpected read: %d %v", n, err)
+	}
+}
+
+func TestWriterCloseWipe(t *testing.T) {
+	cw, err := NewWriterWithOptions(ioutil.Discard, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	_, err = cw.Write([]byte("testtesttest"))
+	if err != nil {
+		t.Fatalf("crypto writer error: %v", err)
+	}
+
+	err = cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+
+	if *cw.c.dKey != [32]byte{} {
+		t.Errorf("key not wiped: %x", cw.c.dKey[:])
+	}
+
+	if bytes.Equal(cw.buf[:cap(cw.buf)], make([]byte, cap(cw.buf))) != true {
+		t.Errorf("buffer not wiped")
+	}
+}
+
+func TestWriterShortWrite(t *testing.T) {
+	cw, err := NewWriterWithOptions(&TestWriterShort{}, "password", Options{KDF: cheapKDF})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	_, err = cw.Write(make([]byte, DefaultChunkSize))
+	if err != nil {
+		t.Fatalf("crypto writer error: %v", err)
+	}
+
+	// the buffered chunk is sealed now and written short
+	_, err = cw.Write([]byte("testtesttest"))
+	we, ok := err.(*WriteError)
+	if ok != true || we.Err != io.ErrShortWrite {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// and it sticks
+	n, err := cw.Write([]byte("testtesttest"))
+	if err != we || n != 0 {
+		t.Errorf("unexpected error: %d/%v (vs %v)", n, err, we)
+	}
+
+	err = cw.Flush()
+	if err != we {
+		t.Errorf("unexpected error: %v (vs %v)", err, we)
+	}
+
+	err = cw.Close()
+	if err != we {
+		t.Errorf("unexpected error: %v (vs %v)", err, we)
+	}
+
+	// Close still wipes the key
+	if *cw.c.dKey != [32]byte{} {
+		t.Errorf("key not wiped: %x", cw.c.dKey[:])
+	}
+}
+
+func TestWriteErrorIs(t *testing.T) {
+	err := &WriteError{Err: errWriter}
+
+	if err.Is(ErrWrite) != true || err.Is(ErrRead) == true {
+		t.Errorf("unexpected Is() on %v", err)
+	}
+
+	if err.Unwrap() != errWriter {
+		t.Errorf("unexpected Unwrap() %v (vs %v)", err.Unwrap(), errWriter)
+	}
+}
@@ -0,0 +1,289 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+//
+// ENVELOPES
+//
+//
+
+const (
+	// password slot: the file key sealed with a key derived from the password
+	slotPassword = 2
+
+	// a reader derives at most this many password slot keys, their passes
+	// add up to the reader time limit
+	maxPasswordSlots = 8
+)
+
+// Recipient is a credential the file key of an envelope stream is wrapped
+// for, see X25519Recipient and PasswordRecipient.
+type Recipient interface {
+	wrap(fileKey *[32]byte) (slot, error)
+}
+
+// x25519Recipient wraps the file key for a public key.
+type x25519Recipient struct {
+	publicKey *[32]byte
+}
+
+func (r x25519Recipient) wrap(fileKey *[32]byte) (slot, error) {
+	return sealX25519(fileKey, r.publicKey)
+}
+
+// X25519Recipient returns the recipient of the X25519 'publicKey', its
+// identity decrypts with NewReaderWithIdentity.
+func X25519Recipient(publicKey *[32]byte) Recipient {
+	return x25519Recipient{publicKey: publicKey}
+}
+
+// passwordRecipient wraps the file key for a password.
+type passwordRecipient struct {
+	password string
+	kdf      KDF
+}
+
+func (r passwordRecipient) wrap(fileKey *[32]byte) (slot, error) {
+	// a default reader would refuse the slot
+	if r.kdf != nil {
+		if err := (ReaderOptions{}).checkKDF(r.kdf); err != nil {
+			return slot{}, err
+		}
+	}
+	return sealPassword(fileKey, r.password, r.kdf)
+}
+
+// PasswordRecipient returns the recipient of 'password' stretched with
+// 'kdf', nil uses the default Argon2id costs, the password decrypts with
+// NewReader. Writing the slot returns ErrKDFLimits when the costs of 'kdf'
+// are out of its own limits (see KDF.Limits).
+func PasswordRecipient(password string, kdf KDF) Recipient {
+	return passwordRecipient{password: password, kdf: kdf}
+}
+
+// sealPassword wraps 'fileKey' with a key derived from 'password' and a
+// random slot salt, deriveKey unwraps the slot rather than the stream.
+//
+//	kdf        uint8     key derivation function identifier
+//	paramsLen  uint16    length of the serialized KDF parameters
+//	params     []byte    serialized KDF parameters
+//	salt       [32]byte  KDF salt
+//	sealed     [48]byte  secretbox of the file key, zero nonce
+func sealPassword(fileKey *[32]byte, password string, kdf KDF) (slot, error) {
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	defer c.wipe()
+
+	if kdf != nil {
+		if _, ok := lookupKDF(kdf.ID()); ok != true {
+			return slot{}, ErrUnsupported
+		}
+		c.kdf = kdf
+	}
+
+	_, err := rand.Read(c.salt)
+	if err != nil {
+		return slot{}, err
+	}
+	err = c.deriveKey(c.salt, password)
+	if err != nil {
+		return slot{}, err
+	}
+
+	// the slot key is never reused
+	var nonce [24]byte
+	params := c.kdf.MarshalParams()
+	body := []byte{c.kdf.ID(), byte(len(params) >> 8), byte(len(params))}
+	body = append(body, params...)
+	body = append(body, c.salt...)
+	body = secretbox.Seal(body, fileKey[:], &nonce, c.dKey)
+	return slot{typ: slotPassword, body: body}, nil
+}
+
+// slotKDF returns the key derivation of a password slot (see sealPassword).
+func slotKDF(s slot) (KDF, error) {
+	b := s.body
+	if len(b) < 3 {
+		return nil, ErrBadHeader
+	}
+	n := int(binary.BigEndian.Uint16(b[1:]))
+	if len(b) != 3+n+SaltLength+keyLength+secretbox.Overhead {
+		return nil, ErrBadHeader
+	}
+
+	proto, ok := lookupKDF(b[0])
+	if ok != true {
+		return nil, ErrUnsupported
+	}
+	return proto.UnmarshalParams(b[3 : 3+n])
+}
+
+// openPassword unwraps the file key of a password slot derived with 'kdf'
+// into c.dKey.
+func (c *NaclPipe) openPassword(s slot, kdf KDF, password string) (bool, error) {
+	b := s.body
+	n := len(b) - SaltLength - keyLength - secretbox.Overhead
+
+	slotPipe := new(NaclPipe)
+	slotPipe.initialize(DerivateArgon2id)
+	defer slotPipe.wipe()
+	slotPipe.kdf = kdf
+	slotPipe.salt = b[n : n+SaltLength]
+
+	err := slotPipe.deriveKey(slotPipe.salt, password)
+	if err != nil {
+		return false, err
+	}
+
+	var nonce [24]byte
+	fileKey, ok := secretbox.Open(nil, b[n+SaltLength:], &nonce, slotPipe.dKey)
+	if ok != true {
+		return false, nil
+	}
+	copy(c.dKey[:], fileKey)
+	wipe(fileKey)
+	return true, nil
+}
+
+// chargePasswordSlot checks the costs of the password slot 's' against
+// 'limits' and adds its passes to 'spent': every slot a reader tries counts,
+// a header crowded with costly slots cannot multiply the time limit.
+func chargePasswordSlot(s slot, limits ReaderOptions, spent *uint64) (KDF, error) {
+	kdf, err := slotKDF(s)
+	if err != nil {
+		return nil, err
+	}
+	err = limits.checkKDF(kdf)
+	if err != nil {
+		return nil, err
+	}
+	_, passes := kdf.Cost()
+	*spent = addCost(*spent, passes)
+	if *spent > limit(limits.MaxKDFTime, kdf.Limits().MaxTime) {
+		return nil, ErrKDFLimits
+	}
+	return kdf, nil
+}
+
+// openPasswordSlots unwraps the file key of an envelope stream with
+// 'password', trying at most maxPasswordSlots slots whose passes add up to
+// the reader time limit, and returns the index of the slot it opened with
+// the file key the header commits to.
+func (c *NaclPipe) openPasswordSlots(password string) (int, error) {
+	tried := 0
+	var spent uint64
+	for i, s := range c.slots {
+		if s.typ != slotPassword {
+			continue
+		}
+		tried++
+		if tried > maxPasswordSlots {
+			return -1, ErrKDFLimits
+		}
+		kdf, err := chargePasswordSlot(s, c.limits, &spent)
+		if err != nil {
+			return -1, err
+		}
+
+		// a slot opening to another file key is not ours, see commits()
+		ok, err := c.openPassword(s, kdf, password)
+		if err != nil {
+			return -1, err
+		}
+		if ok && c.commits() {
+			return i, nil
+		}
+	}
+	return -1, ErrWrongKey
+}
+
+// checkPasswordSlots returns ErrKDFLimits when a default reader would not
+// try every password slot of 'slots'.
+func checkPasswordSlots(slots []slot) error {
+	tried := 0
+	var spent uint64
+	for _, s := range slots {
+		if s.typ != slotPassword {
+			continue
+		}
+		tried++
+		if tried > maxPasswordSlots {
+			return ErrKDFLimits
+		}
+		_, err := chargePasswordSlot(s, ReaderOptions{}, &spent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewEnvelopeWriter initialize an io.WriteCloser encrypting with a random
+// file key wrapped for each of the 'recipients', any mix of passwords and
+// public keys, any of them decrypts the stream: passwords with NewReader
+// and identities with NewReaderWithIdentity. Close() must be called to
+// terminate the stream.
+// Example:
+//	cryptoWriter, err := naclpipe.NewEnvelopeWriter(os.Stdout,
+//		naclpipe.PasswordRecipient("oncallpassword", nil),
+//		naclpipe.X25519Recipient(opsPublicKey))
+//	if err != nil {
+//		return err
+//	}
+//	defer cryptoWriter.Close()
+func NewEnvelopeWriter(w io.Writer, recipients ...Recipient) (*Writer, error) {
+	return NewEnvelopeWriterWithOptions(w, Options{}, recipients...)
+}
+
+// NewEnvelopeWriterWithOptions is NewEnvelopeWriter with the chunk size, cipher
+// suite and signer of 'opts', password recipients have their own KDF.
+func NewEnvelopeWriterWithOptions(w io.Writer, opts Options, recipients ...Recipient) (*Writer, error) {
+	if len(recipients) == 0 || opts.KDF != nil || opts.Deterministic {
+		return nil, ErrUnsupported
+	}
+
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.kdf = nil
+	err := c.setOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file key only ever exists wrapped
+	_, err = rand.Read(c.dKey[:])
+	if err != nil {
+		return nil, err
+	}
+	for _, recipient := range recipients {
+		s, err := recipient.wrap(c.dKey)
+		if err != nil {
+			c.wipe()
+			return nil, err
+		}
+		c.slots = append(c.slots, s)
+	}
+	err = checkPasswordSlots(c.slots)
+	if err != nil {
+		c.wipe()
+		return nil, err
+	}
+	// room for Rewrap to add a slot in place
+	c.slots = append(c.slots, slot{typ: slotPadding, body: make([]byte, rewrapReserve-slotHeaderLength)})
+
+	err = c.initWriter(w, "")
+	if err != nil {
+		c.wipe()
+		return nil, err
+	}
+	return &Writer{c: c, buf: make([]byte, 0, c.chunkSize)}, nil
+}
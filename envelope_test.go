@@ -0,0 +1,241 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// uncommittedRecipient wraps another file key for its recipient, as a slot
+// crafted to open with a password it was not sealed for.
+type uncommittedRecipient struct {
+	Recipient
+}
+
+func (r uncommittedRecipient) wrap(fileKey *[32]byte) (slot, error) {
+	return r.Recipient.wrap(new([32]byte))
+}
+
+// weakRecipient seals a password slot with costs out of the reader limits,
+// as an older writer did.
+type weakRecipient struct {
+	password string
+	kdf      KDF
+}
+
+func (r weakRecipient) wrap(fileKey *[32]byte) (slot, error) {
+	return sealPassword(fileKey, r.password, r.kdf)
+}
+
+// craftedEnvelope returns an empty envelope stream for 'recipients'
+// regardless of the writer checks, as a crafted header.
+func craftedEnvelope(t *testing.T, recipients ...Recipient) []byte {
+	iobuf := new(bytes.Buffer)
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.kdf = nil
+
+	_, err := rand.Read(c.dKey[:])
+	if err != nil {
+		t.Fatalf("rand error: %v", err)
+	}
+	for _, recipient := range recipients {
+		s, err := recipient.wrap(c.dKey)
+		if err != nil {
+			t.Fatalf("wrap error: %v", err)
+		}
+		c.slots = append(c.slots, s)
+	}
+	err = c.initWriter(iobuf, "")
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+	writeStream(t, &Writer{c: c, buf: make([]byte, 0, c.chunkSize)}, nil)
+	return iobuf.Bytes()
+}
+
+/*
+ *
+ *
+ *
+ *
+ * ENVELOPE TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestEnvelopeMixedSlots(t *testing.T) {
+	opsPublic, ops := testIdentity(t)
+	b := []byte("ops and on-call")
+
+	recipients := []Recipient{
+		PasswordRecipient("oncallpassword", cheapKDF),
+		X25519Recipient(opsPublic),
+		PasswordRecipient("backuppassword", cheapKDF),
+	}
+	stream := encryptStream(t, envelopeWriter(recipients...), Options{}, b)
+
+	readers := []func() (*Reader, error){
+		func() (*Reader, error) {
+			return NewReader(bytes.NewReader(stream), "oncallpassword", DerivateArgon2id)
+		},
+		func() (*Reader, error) {
+			return NewReader(bytes.NewReader(stream), "backuppassword", DerivateArgon2id)
+		},
+		func() (*Reader, error) {
+			return NewReaderWithIdentity(bytes.NewReader(stream), ops)
+		},
+	}
+
+	for _, reader := range readers {
+		cr, err := reader()
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+
+		out, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if bytes.Equal(b, out) != true {
+			t.Fatalf("data do not match")
+		}
+	}
+}
+
+func TestEnvelopeWrongPassword(t *testing.T) {
+	stream := encryptStream(t, envelopeWriter(PasswordRecipient("oncallpassword", cheapKDF)), Options{}, nil)
+
+	_, err := NewReader(bytes.NewReader(stream), "wrongpassword", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+
+	// the slot seal is authenticated
+	stream[headerFixedLength+slotHeaderLength+3+len(cheapKDF.MarshalParams())+SaltLength] ^= 0x01
+	_, err = NewReader(bytes.NewReader(stream), "oncallpassword", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestEnvelopeKeyCommitment(t *testing.T) {
+	opsPublic, ops := testIdentity(t)
+	b := []byte("committed")
+
+	// slots opening to another file key are skipped
+	recipients := []Recipient{
+		uncommittedRecipient{PasswordRecipient("oncallpassword", cheapKDF)},
+		uncommittedRecipient{X25519Recipient(opsPublic)},
+		PasswordRecipient("oncallpassword", cheapKDF),
+		X25519Recipient(opsPublic),
+	}
+	stream := encryptStream(t, envelopeWriter(recipients...), Options{}, b)
+	decrypts(t, stream, b, func(r *bytes.Reader) (*Reader, error) {
+		return NewReader(r, "oncallpassword", DerivateArgon2id)
+	})
+	decrypts(t, stream, b, func(r *bytes.Reader) (*Reader, error) {
+		return NewReaderWithIdentity(r, ops)
+	})
+
+	stream = encryptStream(t, envelopeWriter(recipients[:2]...), Options{}, b)
+	_, err := NewReader(bytes.NewReader(stream), "oncallpassword", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+	_, err = NewReaderWithIdentity(bytes.NewReader(stream), ops)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestEnvelopeSlotLimits(t *testing.T) {
+	weak := Argon2Params{CostTime: 1, CostMemory: 1024, CostThreads: 1}
+	stream := craftedEnvelope(t, weakRecipient{"oncallpassword", weak})
+
+	// every slot is checked against the reader limits
+	_, err := NewReader(bytes.NewReader(stream), "oncallpassword", DerivateArgon2id)
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "oncallpassword", ReaderOptions{MinKDFMemory: 1024 * 1024})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEnvelopeTooManyPasswordSlots(t *testing.T) {
+	var recipients []Recipient
+	for i := 0; i <= maxPasswordSlots; i++ {
+		recipients = append(recipients, PasswordRecipient("oncallpassword", cheapKDF))
+	}
+	stream := craftedEnvelope(t, recipients...)
+
+	_, err := NewReader(bytes.NewReader(stream), "wrongpassword", DerivateArgon2id)
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+
+	_, err = NewEnvelopeWriter(ioutil.Discard, recipients...)
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+}
+
+func TestEnvelopePasswordSlotsTime(t *testing.T) {
+	useTestKDF()
+	// 32 passes each, a reader tries two within the 64 passes of testKDF
+	kdf := testKDF{rounds: 31, length: keyLength}
+	recipients := []Recipient{
+		PasswordRecipient("oncallpassword", kdf),
+		PasswordRecipient("backuppassword", kdf),
+		PasswordRecipient("vaultpassword", kdf),
+	}
+
+	_, err := NewEnvelopeWriter(ioutil.Discard, recipients...)
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+
+	stream := craftedEnvelope(t, recipients...)
+	_, err = NewReader(bytes.NewReader(stream), "backuppassword", DerivateArgon2id)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the passes of every slot tried count, not only the last one
+	for _, password := range []string{"vaultpassword", "wrongpassword"} {
+		_, err = NewReader(bytes.NewReader(stream), password, DerivateArgon2id)
+		if err != ErrKDFLimits {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+		}
+	}
+
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "vaultpassword", ReaderOptions{MaxKDFTime: 96})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEnvelopeInvalid(t *testing.T) {
+	_, err := NewEnvelopeWriter(ioutil.Discard)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+
+	_, err = NewEnvelopeWriter(ioutil.Discard, PasswordRecipient("oncallpassword", unregisteredKDF{}))
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+
+	_, err = NewEnvelopeWriter(ioutil.Discard, PasswordRecipient("pass", cheapKDF))
+	if err != ErrUnsafe {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsafe)
+	}
+}
@@ -0,0 +1,95 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"errors"
+	"fmt"
+)
+
+//
+//
+// ERRORS
+//
+//
+
+var (
+	// ErrUnsupported triggers for using an unsupported derivation function.
+	ErrUnsupported = errors.New("unsupported option")
+	// ErrUnsafe triggers for unsafe key derivation function.
+	ErrUnsafe = errors.New("unsafe option")
+	// ErrRead triggers on an error from the underlying io.Reader, every *AuthError matches it.
+	ErrRead = errors.New("read error")
+	// ErrWrite triggers on an error from the underlying io.Writer, every *WriteError matches it.
+	ErrWrite = errors.New("write error")
+	// ErrBadHeader triggers when the stream does not start with a valid naclpipe header.
+	ErrBadHeader = errors.New("bad header")
+	// ErrUnsupportedVersion triggers when the stream header has an unknown format version,
+	// or on a legacy stream when ReaderOptions.RequireCommitment is set.
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+	// ErrKDFLimits triggers when the key derivation costs of a stream header
+	// are outside the ReaderOptions limits, or when a writer is given costs
+	// outside the limits of the function (see KDF.Limits).
+	ErrKDFLimits = errors.New("key derivation costs out of limits")
+	// ErrBadKeyFile triggers when a key file is malformed or fails its checksum.
+	ErrBadKeyFile = errors.New("bad key file")
+	// ErrWrongKey triggers when the password does not decrypt the stream,
+	// NewReader checks it against the header key check. Legacy streams have
+	// no key check, there it is the first chunk failing to open, which a
+	// corruption of that chunk also triggers.
+	ErrWrongKey = errors.New("wrong key")
+	// ErrHeaderSize triggers when Rewrap cannot fit the new stream header in
+	// place of the old one, see RewrapTo.
+	ErrHeaderSize = errors.New("rewrapped header does not fit in place")
+	// ErrNotEnvelope triggers when Rewrap is given a password or keyed stream,
+	// they have no slots and their key only changes by re-encrypting them.
+	ErrNotEnvelope = errors.New("not an envelope stream")
+	// ErrBadSignature triggers when the signature of a signed stream does not
+	// verify, or the stream is not signed by a trusted signer.
+	ErrBadSignature = errors.New("bad signature")
+	// ErrContextMismatch triggers when the associated data of a reader is
+	// not the associated data the stream was written with.
+	ErrContextMismatch = errors.New("associated data mismatch")
+	// ErrTruncated triggers when the stream ends before its final chunk.
+	ErrTruncated = errors.New("truncated stream")
+	// ErrTrailingData triggers when data follows the final chunk.
+	ErrTrailingData = errors.New("trailing data after the final chunk")
+	// ErrCounterOverflow triggers when a stream runs out of chunk nonces.
+	ErrCounterOverflow = errors.New("chunk counter overflow")
+)
+
+// AuthError triggers when a chunk is corrupted and fails authentication,
+// it matches ErrRead.
+type AuthError struct {
+	Chunk  uint64 // chunk index
+	Offset int64  // byte offset of the chunk in the stream
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("chunk %d at offset %d failed authentication", e.Chunk, e.Offset)
+}
+
+// Is reports whether target is ErrRead.
+func (e *AuthError) Is(target error) bool {
+	return target == ErrRead
+}
+
+// WriteError is the sticky error of a Writer once the underlying io.Writer
+// failed or wrote short, it matches ErrWrite and unwraps to the cause.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return ErrWrite.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying io.Writer error.
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrWrite.
+func (e *WriteError) Is(target error) bool {
+	return target == ErrWrite
+}
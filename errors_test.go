@@ -0,0 +1,39 @@
+// +build go1.13
+
+package naclpipe
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorsIs(t *testing.T) {
+	var authErr error = &AuthError{Chunk: 3, Offset: 1234}
+	var writeErr error = &WriteError{Err: errWriter}
+
+	if errors.Is(authErr, ErrRead) != true {
+		t.Errorf("%v should match %v", authErr, ErrRead)
+	}
+
+	if errors.Is(writeErr, ErrWrite) != true || errors.Is(writeErr, errWriter) != true {
+		t.Errorf("%v should match %v and %v", writeErr, ErrWrite, errWriter)
+	}
+
+	if errors.Is(authErr, ErrWrite) == true || errors.Is(writeErr, ErrRead) == true {
+		t.Errorf("unexpected match")
+	}
+}
+
+func TestErrorsAs(t *testing.T) {
+	err := fmt.Errorf("decrypting backup: %w", &AuthError{Chunk: 3, Offset: 1234})
+
+	var ae *AuthError
+	if errors.As(err, &ae) != true {
+		t.Fatalf("%v should be an AuthError", err)
+	}
+
+	if ae.Chunk != 3 || ae.Offset != 1234 {
+		t.Errorf("unexpected chunk %d offset %d", ae.Chunk, ae.Offset)
+	}
+}
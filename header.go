@@ -0,0 +1,333 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+//
+// HEADER
+//
+//
+
+// A naclpipe stream starts with a self-describing header followed by the
+// encrypted chunks, the header carries everything a reader needs to derive
+// the key:
+//
+//	magic      [8]byte   "naclpipe"
+//	version    uint8     stream format version
+//	kdf        uint8     key derivation function identifier (see KDF), 0 for keyed streams, 3 for envelopes
+//	paramsLen  uint16    length of the serialized KDF parameters
+//	params     []byte    serialized KDF parameters or envelope slots
+//	chunkSize  uint32    maximum plaintext size of a chunk
+//	salt       [32]byte  KDF and subkeys salt
+//	nonce      [15]byte  random chunk nonce prefix
+//	check      [32]byte  key check, HMAC-SHA256 of the header fields above
+//
+// the key check is keyed with a subkey of the derived key, a reader tells a
+// wrong password (or a tampered header) before reading any chunk. It also
+// commits the stream to that key (see headerCheck), a stream only decrypts
+// with one key and an envelope slot only opens with its file key. Keyed
+// streams (see NewWriterWithKey) have no KDF parameters, their subkeys come
+// from the key and the salt. Envelope streams (see NewWriterForRecipients)
+// encrypt with a random file key wrapped in slots:
+//
+//	type       uint8     slot type
+//	length     uint16    length of the slot body
+//	body       []byte    the wrapped file key
+//
+// an X25519 slot (type 1) body is an ephemeral public key followed by the
+// nacl/box of the file key for a recipient, a password slot (type 2) body
+// is a KDF identifier, its parameters and salt followed by the secretbox of
+// the file key with the derived key (see sealPassword). Both are sealed with
+// a zero nonce as their key is never reused. A padding slot (type 0) only
+// reserves room for Rewrap and is skipped by readers.
+//
+// each encrypted chunk is then framed as:
+//
+//	length     uint32    length of the sealed chunk, top bit set on the final chunk
+//	sealed     []byte    AEAD (secretbox by default) of at most chunkSize bytes of plaintext
+//
+// the chunk nonce is the header nonce prefix, the uint64 chunk counter and
+// the final flag, a stream that ends without a final chunk is truncated.
+//
+// FormatV2 headers have extensions between the nonce prefix and the key
+// check, writers only use it for streams that need them:
+//
+//	extLen     uint16    length of the extensions
+//	extensions []byte    type uint8, length uint16, body
+//
+// readers reject unknown extensions. A signed stream has a signer extension
+// (type 1) with the Ed25519 public key of its signer and its final chunk is
+// followed by the signature (see Options.Signer). A cipher suite extension
+// (type 2) has the CipherSuite of the chunks when it is not secretbox. The
+// empty deterministic extension (type 3) flags a stream with synthetic chunk
+// nonces (see Options.Deterministic), each of its sealed chunks starts with
+// the 24 bytes synthetic nonce. The context extension (type 4) has the
+// context tag of a stream bound to associated data (see Options.AssociatedData)
+// and the metadata extension (type 5) its encrypted Metadata.
+//
+// all integers are big endian.
+const (
+	// FormatLegacy is the headerless v0.2 stream format: the raw salt
+	// followed by secretbox chunks of the writer's buffer size.
+	FormatLegacy = 0
+	// FormatV1 is the first headered stream format.
+	FormatV1 = 1
+	// FormatV2 is FormatV1 with header extensions.
+	FormatV2 = 2
+
+	headerMagic   = "naclpipe"
+	formatVersion = FormatV2 // newest format version
+
+	// KDF identifiers as recorded in the header, see RegisterKDF
+	kdfIDNone     = 0 // keyed stream, see NewWriterWithKey
+	kdfIDScrypt   = 1
+	kdfIDArgon2id = 2
+	kdfIDEnvelope = 3   // random file key in slots, see NewWriterForRecipients
+	kdfIDUser     = 128 // first ID RegisterKDF accepts, the lower ones are reserved
+
+	// header extension types
+	extSigner        = 1 // see Options.Signer
+	extCipherSuite   = 2 // see Options.CipherSuite
+	extDeterministic = 3 // see Options.Deterministic
+	extContext       = 4 // see Options.AssociatedData
+	extMetadata      = 5 // see Options.Metadata
+
+	// DefaultChunkSize is the plaintext size of a chunk written by a naclpipe writer.
+	DefaultChunkSize = 64 * 1024
+	// MaxChunkSize is the largest chunk size a naclpipe reader accepts from a header.
+	MaxChunkSize = 16 * 1024 * 1024
+
+	// magic + version + kdf + paramsLen
+	headerFixedLength = len(headerMagic) + 1 + 1 + 2
+	// HMAC-SHA256
+	headerCheckLength = 32
+)
+
+// header is the decoded form of a stream header.
+type header struct {
+	version       uint8
+	kdf           KDF
+	chunkSize     uint32
+	salt          []byte
+	noncePrefix   []byte
+	slots         []slot            // wrapped file keys of an envelope stream
+	suite         CipherSuite       // cipher suite extension
+	deterministic bool              // deterministic extension
+	context       []byte            // context tag extension
+	metadata      []byte            // sealed metadata extension
+	signer        ed25519.PublicKey // signer extension
+	check         []byte
+	raw           []byte // serialized header as read, without the key check
+}
+
+// marshal serializes the header fields covered by the key check.
+func (h *header) marshal() ([]byte, error) {
+	var id uint8
+	var params []byte
+	switch {
+	case h.slots != nil:
+		id, params = kdfIDEnvelope, marshalSlots(h.slots)
+	case h.kdf != nil:
+		id, params = h.kdf.ID(), h.kdf.MarshalParams()
+	}
+	if len(params) > math.MaxUint16 {
+		return nil, ErrUnsupported
+	}
+
+	b := make([]byte, 0, headerFixedLength+len(params)+4+len(h.salt)+len(h.noncePrefix))
+	b = append(b, headerMagic...)
+	b = append(b, h.version, id)
+	b = append(b, byte(len(params)>>8), byte(len(params)))
+	b = append(b, params...)
+	b = append(b, byte(h.chunkSize>>24), byte(h.chunkSize>>16), byte(h.chunkSize>>8), byte(h.chunkSize))
+	b = append(b, h.salt...)
+	b = append(b, h.noncePrefix...)
+
+	if h.version >= FormatV2 {
+		ext := h.marshalExtensions()
+		if len(ext) > math.MaxUint16 {
+			return nil, ErrUnsupported
+		}
+		b = append(b, byte(len(ext)>>8), byte(len(ext)))
+		b = append(b, ext...)
+	}
+	return b, nil
+}
+
+// marshalExtensions serializes the FormatV2 header extensions.
+func (h *header) marshalExtensions() []byte {
+	var b []byte
+	if h.signer != nil {
+		b = append(b, extSigner, byte(len(h.signer)>>8), byte(len(h.signer)))
+		b = append(b, h.signer...)
+	}
+	if h.suite != SuiteSecretbox {
+		b = append(b, extCipherSuite, 0, 1, byte(h.suite))
+	}
+	if h.deterministic {
+		b = append(b, extDeterministic, 0, 0)
+	}
+	if h.context != nil {
+		b = append(b, extContext, 0, contextTagLength)
+		b = append(b, h.context...)
+	}
+	if h.metadata != nil {
+		b = append(b, extMetadata, byte(len(h.metadata)>>8), byte(len(h.metadata)))
+		b = append(b, h.metadata...)
+	}
+	return b
+}
+
+// unmarshalExtensions decodes the FormatV2 header extensions.
+func (h *header) unmarshalExtensions(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return ErrBadHeader
+		}
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+n {
+			return ErrBadHeader
+		}
+		body := b[3 : 3+n]
+
+		switch b[0] {
+		case extSigner:
+			if h.signer != nil || n != ed25519.PublicKeySize {
+				return ErrBadHeader
+			}
+			h.signer = ed25519.PublicKey(body)
+		case extCipherSuite:
+			// secretbox is the default, it has no extension
+			if h.suite != SuiteSecretbox || n != 1 || CipherSuite(body[0]) == SuiteSecretbox {
+				return ErrBadHeader
+			}
+			h.suite = CipherSuite(body[0])
+			if h.suite.valid() != true {
+				return ErrUnsupported
+			}
+		case extDeterministic:
+			if h.deterministic || n != 0 {
+				return ErrBadHeader
+			}
+			h.deterministic = true
+		case extContext:
+			if h.context != nil || n != contextTagLength {
+				return ErrBadHeader
+			}
+			h.context = body
+		case extMetadata:
+			if h.metadata != nil || n < 24+secretbox.Overhead {
+				return ErrBadHeader
+			}
+			h.metadata = body
+		default:
+			// an unknown extension may change how the stream reads
+			return ErrUnsupported
+		}
+		b = b[3+n:]
+	}
+	return nil
+}
+
+// readFull reads exactly len(b) bytes of a header from 'r'.
+func readFull(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readHeader reads and validates a stream header from r.
+func readHeader(r io.Reader) (*header, error) {
+	fixed := make([]byte, headerFixedLength)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	if string(fixed[:len(headerMagic)]) != headerMagic {
+		return nil, ErrBadHeader
+	}
+	raw := fixed
+	fixed = fixed[len(headerMagic):]
+
+	h := &header{
+		version: fixed[0],
+	}
+	if h.version < FormatV1 || h.version > formatVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	// params + chunkSize + salt + nonce prefix
+	tail := 4 + SaltLength + noncePrefixLength
+	rest := make([]byte, int(binary.BigEndian.Uint16(fixed[2:]))+tail)
+	if err := readFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	// keyed streams have no KDF, envelope streams have slots
+	var k KDF
+	switch id := fixed[1]; id {
+	case kdfIDNone:
+		if len(rest) != tail {
+			return nil, ErrBadHeader
+		}
+	case kdfIDEnvelope:
+		slots, err := unmarshalSlots(rest[:len(rest)-tail])
+		if err != nil {
+			return nil, err
+		}
+		h.slots = slots
+	default:
+		proto, ok := lookupKDF(id)
+		if ok != true {
+			return nil, ErrUnsupported
+		}
+		var err error
+		k, err = proto.UnmarshalParams(rest[:len(rest)-tail])
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.raw = append(raw, rest...)
+	rest = rest[len(rest)-tail:]
+
+	h.kdf = k
+	h.chunkSize = binary.BigEndian.Uint32(rest)
+	h.salt = rest[4 : 4+SaltLength]
+	h.noncePrefix = rest[4+SaltLength:]
+
+	if h.chunkSize == 0 || h.chunkSize > MaxChunkSize {
+		return nil, ErrBadHeader
+	}
+
+	if h.version >= FormatV2 {
+		extLen := make([]byte, 2)
+		if err := readFull(r, extLen); err != nil {
+			return nil, err
+		}
+		ext := make([]byte, binary.BigEndian.Uint16(extLen))
+		if err := readFull(r, ext); err != nil {
+			return nil, err
+		}
+		if err := h.unmarshalExtensions(ext); err != nil {
+			return nil, err
+		}
+		h.raw = append(append(h.raw, extLen...), ext...)
+	}
+
+	h.check = make([]byte, headerCheckLength)
+	if err := readFull(r, h.check); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
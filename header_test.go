@@ -0,0 +1,158 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// testHeader returns a serialized valid FormatV1 header using 'kdf' and
+// 'salt', its key check matches "password" unless the salt is unsafe.
+func testHeader(t *testing.T, kdf KDF, salt []byte) []byte {
+	h := &header{
+		version:     FormatV1,
+		kdf:         kdf,
+		chunkSize:   DefaultChunkSize,
+		salt:        salt,
+		noncePrefix: make([]byte, noncePrefixLength),
+	}
+	b, err := h.marshal()
+	if err != nil {
+		t.Fatalf("header marshal error: %v", err)
+	}
+
+	c := new(NaclPipe)
+	c.initialize(DerivateScrypt)
+	c.kdf = kdf
+	c.salt = salt
+
+	check := make([]byte, headerCheckLength)
+	if c.deriveKey(salt, "password") == nil {
+		check, err = c.expandKey(b)
+		if err != nil {
+			t.Fatalf("key check error: %v", err)
+		}
+	}
+	return append(b, check...)
+}
+
+// testStream returns a reader producing a valid header followed by 'body'.
+func testStream(t *testing.T, kdf KDF, salt []byte, body io.Reader) io.Reader {
+	return io.MultiReader(bytes.NewReader(testHeader(t, kdf, salt)), body)
+}
+
+// randomSalt returns a CSPRNG salt.
+func randomSalt(t *testing.T) []byte {
+	salt := make([]byte, SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatalf("salt error: %v", err)
+	}
+	return salt
+}
+
+/*
+ *
+ *
+ *
+ *
+ * HEADER TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, kdf := range []KDF{cheapScrypt, cheapKDF} {
+		salt := randomSalt(t)
+
+		h, err := readHeader(bytes.NewReader(testHeader(t, kdf, salt)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if h.version != FormatV1 || h.chunkSize != DefaultChunkSize {
+			t.Errorf("unexpected header version %d chunk size %d", h.version, h.chunkSize)
+		}
+		if h.kdf != kdf {
+			t.Errorf("unexpected params %v vs %v", h.kdf, kdf)
+		}
+		if bytes.Equal(h.salt, salt) != true {
+			t.Errorf("unexpected salt %x vs %x", h.salt, salt)
+		}
+		if len(h.check) != headerCheckLength {
+			t.Errorf("unexpected key check length %d vs %d", len(h.check), headerCheckLength)
+		}
+	}
+}
+
+func TestHeaderBadMagic(t *testing.T) {
+	_, err := readHeader(rand.Reader)
+	if err != ErrBadHeader {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadHeader)
+	}
+}
+
+func TestHeaderUnsupportedVersion(t *testing.T) {
+	b := testHeader(t, cheapKDF, randomSalt(t))
+	b[len(headerMagic)] = formatVersion + 1
+
+	_, err := readHeader(bytes.NewReader(b))
+	if err != ErrUnsupportedVersion {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestHeaderUnsupportedKDF(t *testing.T) {
+	b := testHeader(t, cheapKDF, randomSalt(t))
+	b[len(headerMagic)+1] = 0xff
+
+	_, err := readHeader(bytes.NewReader(b))
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestHeaderBadChunkSize(t *testing.T) {
+	b := testHeader(t, cheapKDF, randomSalt(t))
+	// chunk size is right before the salt, nonce prefix and key check
+	copy(b[len(b)-headerCheckLength-noncePrefixLength-SaltLength-4:], []byte{0xff, 0xff, 0xff, 0xff})
+
+	_, err := readHeader(bytes.NewReader(b))
+	if err != ErrBadHeader {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadHeader)
+	}
+}
+
+func TestHeaderTruncated(t *testing.T) {
+	b := testHeader(t, cheapScrypt, randomSalt(t))
+
+	_, err := readHeader(bytes.NewReader(b[:len(b)/2]))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error: %v (vs %v)", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestHeaderKeyed(t *testing.T) {
+	b := testHeader(t, nil, randomSalt(t))
+
+	h, err := readHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h.kdf != nil {
+		t.Errorf("unexpected kdf %v", h.kdf)
+	}
+
+	// keyed streams have no KDF parameters
+	b = testHeader(t, cheapKDF, randomSalt(t))
+	b[len(headerMagic)+1] = kdfIDNone
+
+	_, err = readHeader(bytes.NewReader(b))
+	if err != ErrBadHeader {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadHeader)
+	}
+}
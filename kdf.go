@@ -0,0 +1,255 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"golang.org/x/crypto/argon2" //let's add argon2id
+	"golang.org/x/crypto/scrypt" // let's keep scrypt
+)
+
+//
+//
+// KEY DERIVATION
+//
+//
+
+// KDF is a password based key derivation function along with its cost
+// parameters. The stream header records its ID and serialized parameters, a
+// reader looks the ID up in the registry (see RegisterKDF) and derives the
+// key with the parameters read back from the stream.
+type KDF interface {
+	// ID is the identifier of the function recorded in the stream header.
+	ID() uint8
+	// Derive returns the 32 bytes key derived from 'password' and 'salt'.
+	Derive(password, salt []byte) ([]byte, error)
+	// MarshalParams serializes the cost parameters for the stream header.
+	MarshalParams() []byte
+	// UnmarshalParams returns the KDF with the cost parameters read from a
+	// stream header.
+	UnmarshalParams(b []byte) (KDF, error)
+	// Cost returns the memory in bytes and the number of passes over it a
+	// derivation needs, readers check them against their ReaderOptions
+	// before deriving a key.
+	Cost() (memory uint64, passes uint64)
+	// Limits returns the default bounds of the costs of the function,
+	// readers and writers use them where ReaderOptions sets none.
+	Limits() KDFLimits
+}
+
+// KDFLimits bounds the costs (see KDF.Cost) of a key derivation function:
+// costs above the maximums could exhaust a reader, costs below the minimums
+// do not protect the password. A function that is not memory hard has no
+// minimum memory and counts its iterations as passes.
+type KDFLimits struct {
+	MaxMemory uint64
+	MaxTime   uint64
+	MinMemory uint64
+	MinTime   uint64
+}
+
+// memoryHardLimits are the default limits of scrypt and Argon2id.
+var memoryHardLimits = KDFLimits{
+	MaxMemory: DefaultMaxKDFMemory,
+	MaxTime:   DefaultMaxKDFTime,
+	MinMemory: DefaultMinKDFMemory,
+	MinTime:   DefaultMinKDFTime,
+}
+
+// ScryptParams describes the parameters used for calling the scrypt key derivation function.
+type ScryptParams struct {
+	CostParam int
+	CostN     int
+	CostP     int
+	SaltLen   int
+	KeyLength int
+}
+
+// ID returns the scrypt identifier.
+func (p ScryptParams) ID() uint8 {
+	return kdfIDScrypt
+}
+
+// Derive calls scrypt with the parameters, a zero KeyLength derives a 32 bytes key.
+func (p ScryptParams) Derive(password, salt []byte) ([]byte, error) {
+	if p.KeyLength == 0 {
+		p.KeyLength = keyLength
+	}
+	return scrypt.Key(password, salt, p.CostParam, p.CostN, p.CostP, p.KeyLength)
+}
+
+// MarshalParams serializes the scrypt costs.
+func (p ScryptParams) MarshalParams() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:], uint32(p.CostParam))
+	binary.BigEndian.PutUint32(b[4:], uint32(p.CostN))
+	binary.BigEndian.PutUint32(b[8:], uint32(p.CostP))
+	return b
+}
+
+// UnmarshalParams decodes the scrypt costs.
+func (p ScryptParams) UnmarshalParams(b []byte) (KDF, error) {
+	if len(b) != 12 {
+		return nil, ErrBadHeader
+	}
+	return ScryptParams{
+		CostParam: int(binary.BigEndian.Uint32(b[0:])),
+		CostN:     int(binary.BigEndian.Uint32(b[4:])),
+		CostP:     int(binary.BigEndian.Uint32(b[8:])),
+		SaltLen:   SaltLength,
+		KeyLength: keyLength,
+	}, nil
+}
+
+// scryptMaxR is the largest scrypt block size r a cost is computed for,
+// larger blocks only inflate the memory of a derivation.
+const scryptMaxR = 64
+
+// Cost returns the scrypt memory (128 * r * (N + p) + 256 * r bytes, all
+// that scrypt.Key allocates) and passes (2 * p), a block size r above
+// scryptMaxR costs all the memory.
+func (p ScryptParams) Cost() (memory uint64, passes uint64) {
+	passes = mulCost(2, uint64(p.CostP))
+	r := uint64(p.CostN)
+	if r > scryptMaxR {
+		return math.MaxUint64, passes
+	}
+	memory = mulCost(mulCost(128, r), addCost(uint64(p.CostParam), uint64(p.CostP)))
+	return addCost(memory, 256*r), passes
+}
+
+// Limits returns the default limits of the memory hard functions.
+func (p ScryptParams) Limits() KDFLimits {
+	return memoryHardLimits
+}
+
+// Argon2Params describes the parameters used for calling the Argon2id key derivation function.
+type Argon2Params struct {
+	CostTime    uint32
+	CostMemory  uint32
+	CostThreads uint8
+	KeyLength   uint32
+}
+
+// ID returns the Argon2id identifier.
+func (p Argon2Params) ID() uint8 {
+	return kdfIDArgon2id
+}
+
+// Derive calls Argon2id with the parameters, a zero KeyLength derives a 32 bytes key.
+func (p Argon2Params) Derive(password, salt []byte) ([]byte, error) {
+	if p.KeyLength == 0 {
+		p.KeyLength = keyLength
+	}
+	// argon2 panics on these
+	if p.CostTime < 1 || p.CostThreads < 1 {
+		return nil, ErrUnsupported
+	}
+	return argon2.IDKey(password, salt, p.CostTime, p.CostMemory, p.CostThreads, p.KeyLength), nil
+}
+
+// MarshalParams serializes the Argon2id costs.
+func (p Argon2Params) MarshalParams() []byte {
+	b := make([]byte, 9)
+	binary.BigEndian.PutUint32(b[0:], p.CostTime)
+	binary.BigEndian.PutUint32(b[4:], p.CostMemory)
+	b[8] = p.CostThreads
+	return b
+}
+
+// UnmarshalParams decodes the Argon2id costs.
+func (p Argon2Params) UnmarshalParams(b []byte) (KDF, error) {
+	if len(b) != 9 {
+		return nil, ErrBadHeader
+	}
+	return Argon2Params{
+		CostTime:    binary.BigEndian.Uint32(b[0:]),
+		CostMemory:  binary.BigEndian.Uint32(b[4:]),
+		CostThreads: b[8],
+		KeyLength:   keyLength,
+	}, nil
+}
+
+// Cost returns the Argon2id memory (CostMemory KiB) and passes (CostTime).
+func (p Argon2Params) Cost() (memory uint64, passes uint64) {
+	return uint64(p.CostMemory) * 1024, uint64(p.CostTime)
+}
+
+// Limits returns the default limits of the memory hard functions.
+func (p Argon2Params) Limits() KDFLimits {
+	return memoryHardLimits
+}
+
+// DefaultKDF returns the key derivation NewWriter uses for 'derivation',
+// Options.KDF and PasswordRecipient default to Argon2id otherwise. Legacy
+// DerivateScrypt010 streams are never written, it returns ErrUnsupported.
+// Example:
+//	kdf, err := naclpipe.DefaultKDF(naclpipe.DerivateScrypt)
+//	if err != nil {
+//		return err
+//	}
+//	cryptoWriter, err := naclpipe.NewWriterWithOptions(os.Stdout, "mypassword", naclpipe.Options{KDF: kdf})
+func DefaultKDF(derivation int) (KDF, error) {
+	if derivation == DerivateScrypt010 {
+		return nil, ErrUnsupported
+	}
+	c := new(NaclPipe)
+	c.initialize(derivation)
+	return c.kdf, nil
+}
+
+// mulCost multiplies costs, saturating instead of overflowing.
+func mulCost(a, b uint64) uint64 {
+	if a != 0 && b > math.MaxUint64/a {
+		return math.MaxUint64
+	}
+	return a * b
+}
+
+// addCost adds costs, saturating instead of overflowing.
+func addCost(a, b uint64) uint64 {
+	if b > math.MaxUint64-a {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// registered key derivation functions by ID
+var (
+	kdfsMu sync.RWMutex
+	kdfs   = map[uint8]KDF{
+		kdfIDScrypt:   ScryptParams{},
+		kdfIDArgon2id: Argon2Params{},
+	}
+)
+
+// RegisterKDF makes a key derivation function available to readers of the
+// streams recording its ID, usually from an init function. IDs below 128
+// are reserved for the functions of this package. RegisterKDF panics if 'k'
+// is nil, if its ID is reserved or if its ID is already registered.
+func RegisterKDF(k KDF) {
+	if k == nil {
+		panic("naclpipe: RegisterKDF with a nil KDF")
+	}
+	if k.ID() < kdfIDUser {
+		panic("naclpipe: RegisterKDF with a reserved ID")
+	}
+
+	kdfsMu.Lock()
+	defer kdfsMu.Unlock()
+	if _, dup := kdfs[k.ID()]; dup {
+		panic("naclpipe: RegisterKDF called twice for the same ID")
+	}
+	kdfs[k.ID()] = k
+}
+
+// lookupKDF returns the registered KDF identified by 'id'.
+func lookupKDF(id uint8) (KDF, bool) {
+	kdfsMu.RLock()
+	defer kdfsMu.RUnlock()
+	k, ok := kdfs[id]
+	return k, ok
+}
@@ -0,0 +1,260 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math"
+	"sync"
+	"testing"
+)
+
+// testKDF is a cheap (and insecure) key derivation function.
+type testKDF struct {
+	rounds uint8
+	length int
+}
+
+func (k testKDF) ID() uint8 {
+	return 200
+}
+
+func (k testKDF) Derive(password, salt []byte) ([]byte, error) {
+	key := append(password, salt...)
+	for i := uint8(0); i <= k.rounds; i++ {
+		sum := sha256.Sum256(key)
+		key = sum[:]
+	}
+	return key[:k.length], nil
+}
+
+func (k testKDF) MarshalParams() []byte {
+	return []byte{k.rounds}
+}
+
+func (k testKDF) UnmarshalParams(b []byte) (KDF, error) {
+	if len(b) != 1 {
+		return nil, ErrBadHeader
+	}
+	return testKDF{rounds: b[0], length: keyLength}, nil
+}
+
+// one hash state per round, as PBKDF2 iterations
+func (k testKDF) Cost() (memory uint64, passes uint64) {
+	return sha256.Size, uint64(k.rounds) + 1
+}
+
+// not memory hard, up to 64 rounds
+func (k testKDF) Limits() KDFLimits {
+	return KDFLimits{MaxMemory: sha256.Size, MaxTime: 64, MinTime: 1}
+}
+
+// reservedKDF is a testKDF with an ID of this package.
+type reservedKDF struct {
+	testKDF
+}
+
+func (k reservedKDF) ID() uint8 {
+	return kdfIDEnvelope
+}
+
+var registerTestKDF sync.Once
+
+// useTestKDF registers testKDF for the tests deriving with it.
+func useTestKDF() {
+	registerTestKDF.Do(func() {
+		RegisterKDF(testKDF{})
+	})
+}
+
+/*
+ *
+ *
+ *
+ *
+ * KDF TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestKDFParamsRoundTrip(t *testing.T) {
+	c := new(NaclPipe)
+
+	for _, d := range []int{DerivateScrypt, DerivateArgon2id} {
+		c.initialize(d)
+
+		k, err := c.kdf.UnmarshalParams(c.kdf.MarshalParams())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if k != c.kdf {
+			t.Errorf("unexpected params %v vs %v", k, c.kdf)
+		}
+	}
+}
+
+func TestKDFParamsBadLength(t *testing.T) {
+	for _, k := range []KDF{ScryptParams{}, Argon2Params{}} {
+		_, err := k.UnmarshalParams(make([]byte, 3))
+		if err != ErrBadHeader {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrBadHeader)
+		}
+	}
+}
+
+func TestDerivateConstants(t *testing.T) {
+	if DerivateScrypt == DerivateArgon2id || DerivateScrypt == DerivateScrypt010 || DerivateArgon2id == DerivateScrypt010 {
+		t.Errorf("derivations are not distinct: %d %d %d", DerivateScrypt, DerivateArgon2id, DerivateScrypt010)
+	}
+}
+
+func TestRegisteredKDF(t *testing.T) {
+	b := []byte("what you cannot derive you do not read")
+	useTestKDF()
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: testKDF{rounds: 3, length: keyLength}}, b)
+
+	// the header tells the reader which function to use
+	cr, err := NewReader(bytes.NewReader(stream), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	if k, ok := cr.rd.(*NaclPipe).kdf.(testKDF); ok != true || k.rounds != 3 {
+		t.Errorf("unexpected kdf %v", cr.rd.(*NaclPipe).kdf)
+	}
+
+	out, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(b, out) != true {
+		t.Fatalf("data do not match")
+	}
+}
+
+func TestKDFLimits(t *testing.T) {
+	useTestKDF()
+	kdf := testKDF{rounds: 3, length: keyLength}
+
+	// no memory floor for a function that is not memory hard
+	stream := encryptStream(t, envelopeWriter(PasswordRecipient("password", kdf)), Options{}, []byte("slot"))
+	_, err := NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// its own ceiling, unless the reader sets one
+	_, err = NewWriterWithOptions(ioutil.Discard, "password", Options{KDF: testKDF{rounds: 64, length: keyLength}})
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{MaxKDFTime: 2})
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+
+	// scrypt and Argon2id keep their memory floor
+	if err = (ReaderOptions{}).checkKDF(Argon2Params{CostTime: 4, CostMemory: 1, CostThreads: 1}); err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+}
+
+func TestDefaultKDF(t *testing.T) {
+	kdf, err := DefaultKDF(DerivateScrypt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := new(NaclPipe)
+	c.initialize(DerivateScrypt)
+	if kdf != c.kdf {
+		t.Errorf("unexpected KDF: %v (vs %v)", kdf, c.kdf)
+	}
+	// NewWriter would not write it otherwise
+	err = (ReaderOptions{}).checkKDF(kdf)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = DefaultKDF(DerivateScrypt010)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestRegisterKDFDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("duplicate registration did not panic")
+		}
+	}()
+	useTestKDF()
+	RegisterKDF(testKDF{})
+}
+
+func TestRegisterKDFReserved(t *testing.T) {
+	// 3 is not registered, envelope streams record it
+	for _, k := range []KDF{ScryptParams{}, reservedKDF{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("reserved ID %d registration did not panic", k.ID())
+				}
+			}()
+			RegisterKDF(k)
+		}()
+	}
+	if _, ok := lookupKDF(kdfIDEnvelope); ok == true {
+		t.Errorf("reserved ID %d registered", kdfIDEnvelope)
+	}
+}
+
+func TestRegisterKDFNil(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("nil registration did not panic")
+		}
+	}()
+	RegisterKDF(nil)
+}
+
+func TestDeriveKeyLength(t *testing.T) {
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.kdf = testKDF{length: 16}
+
+	err := c.deriveKey(randomSalt(t), "password")
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestKDFCost(t *testing.T) {
+	d := new(NaclPipe)
+
+	for _, v := range []struct {
+		derivation     int
+		memory, passes uint64
+	}{
+		{DerivateScrypt, 128*16*(65536+4) + 256*16, 8},
+		{DerivateArgon2id, 256 * 1024 * 1024, 2},
+		{DerivateScrypt010, 128*8*(16384+1) + 256*8, 2},
+	} {
+		d.initialize(v.derivation)
+		memory, passes := d.kdf.Cost()
+		if memory != v.memory || passes != v.passes {
+			t.Errorf("unexpected cost %d/%d (vs %d/%d) for %v", memory, passes, v.memory, v.passes, d.kdf)
+		}
+	}
+
+	// costs saturate
+	memory, _ := ScryptParams{CostParam: 2, CostN: scryptMaxR + 1, CostP: 1}.Cost()
+	if memory != math.MaxUint64 {
+		t.Errorf("unexpected cost %d (vs %d)", memory, uint64(math.MaxUint64))
+	}
+	if mulCost(math.MaxUint32, math.MaxUint64) != math.MaxUint64 || addCost(math.MaxUint64, 1) != math.MaxUint64 {
+		t.Errorf("costs do not saturate")
+	}
+}
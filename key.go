@@ -0,0 +1,120 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"io"
+)
+
+//
+//
+// KEYS
+//
+//
+
+// DeriveKey stretches 'password' once with 'kdf' and 'salt' into a 32 bytes
+// master key for NewWriterWithKey and NewReaderWithKey, the caller keeps
+// the salt and the KDF parameters to derive it again. The key is a plain
+// *[32]byte, as identities are: streams never record how it was made, so a
+// handle type would carry nothing more, the caller wipes it once done.
+// Example:
+//	key, err := naclpipe.DeriveKey("mypassword", salt, naclpipe.Argon2Params{CostTime: 2, CostMemory: 256 * 1024, CostThreads: 8})
+//	if err != nil {
+//		return err
+//	}
+func DeriveKey(password string, salt []byte, kdf KDF) (*[32]byte, error) {
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.kdf = kdf
+	c.salt = salt
+
+	err := c.deriveKey(salt, password)
+	if err != nil {
+		return nil, err
+	}
+	return c.dKey, nil
+}
+
+// NewWriterWithKey initialize an io.WriteCloser using the 32 bytes master
+// 'key' instead of a password, no key stretching happens: every stream
+// derives its own subkeys from the key and its random salt, the master key
+// is never used directly. Close() must be called to terminate the stream.
+// Example:
+//	cryptoWriter, err := naclpipe.NewWriterWithKey(os.Stdout, key)
+//	if err != nil {
+//		return err
+//	}
+//	defer cryptoWriter.Close()
+func NewWriterWithKey(w io.Writer, key *[32]byte) (*Writer, error) {
+	return NewWriterWithKeyOptions(w, key, Options{})
+}
+
+// NewWriterWithKeyOptions is NewWriterWithKey with the chunk size, cipher
+// suite, signer and determinism of 'opts', keyed streams have no KDF.
+func NewWriterWithKeyOptions(w io.Writer, key *[32]byte, opts Options) (*Writer, error) {
+	if key == nil || opts.KDF != nil {
+		return nil, ErrUnsupported
+	}
+
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.kdf = nil
+	err := c.setOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	copy(c.dKey[:], key[:])
+
+	err = c.initWriter(w, "")
+	if err != nil {
+		c.wipe()
+		return nil, err
+	}
+	return &Writer{c: c, buf: make([]byte, 0, c.chunkSize)}, nil
+}
+
+// NewReaderWithKey initialize an io.Reader decrypting a stream written by
+// NewWriterWithKey with the same master 'key', streams written with a
+// password fail with ErrWrongKey.
+// Example:
+//	cryptoReader, err := naclpipe.NewReaderWithKey(os.Stdin, key)
+//	if err != nil {
+//		return err
+//	}
+func NewReaderWithKey(r io.Reader, key *[32]byte) (*Reader, error) {
+	return NewReaderWithKeyOptions(r, key, ReaderOptions{})
+}
+
+// NewReaderWithKeyOptions is NewReaderWithKey with the trusted signers and
+// associated data of 'opts'.
+func NewReaderWithKeyOptions(r io.Reader, key *[32]byte, opts ReaderOptions) (*Reader, error) {
+	if key == nil {
+		return nil, ErrUnsupported
+	}
+
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.limits = opts
+
+	err := c.initKeyReader(r, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{rd: c, format: int(c.version)}, nil
+}
+
+// initKeyReader reads the header of a keyed stream and checks 'key' with it.
+func (c *NaclPipe) initKeyReader(r io.Reader, key *[32]byte) error {
+	err := c.useHeader(r)
+	if err != nil {
+		return err
+	}
+
+	// password and envelope streams need their KDF or slots
+	if c.kdf != nil || c.slots != nil {
+		return ErrWrongKey
+	}
+
+	copy(c.dKey[:], key[:])
+	return c.checkKey(r)
+}
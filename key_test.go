@@ -0,0 +1,169 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testKey returns a random master key.
+func testKey(t *testing.T) *[32]byte {
+	key := new([32]byte)
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatalf("key error: %v", err)
+	}
+	return key
+}
+
+/*
+ *
+ *
+ *
+ *
+ * KEY TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestKeyRoundTrip(t *testing.T) {
+	key := testKey(t)
+	b := make([]byte, 3*DefaultChunkSize/2)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+
+	stream := encryptStream(t, keyWriter(key), Options{}, b)
+	cr, err := NewReaderWithKey(bytes.NewReader(stream), key)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	// the master key is never the chunk key
+	if bytes.Equal(cr.rd.(*NaclPipe).dKey[:], key[:]) {
+		t.Errorf("master key used as a chunk key")
+	}
+
+	out := new(bytes.Buffer)
+	_, err = io.Copy(out, cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(b, out.Bytes()) != true {
+		t.Fatalf("data do not match")
+	}
+}
+
+func TestKeyStreamSubkeys(t *testing.T) {
+	key := testKey(t)
+
+	// every stream has its own salt and chunk key
+	var keys [][]byte
+	for i := 0; i < 2; i++ {
+		stream := encryptStream(t, keyWriter(key), Options{}, nil)
+		cr, err := NewReaderWithKey(bytes.NewReader(stream), key)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+		keys = append(keys, append([]byte(nil), cr.rd.(*NaclPipe).dKey[:]...))
+	}
+
+	if bytes.Equal(keys[0], keys[1]) {
+		t.Errorf("streams share a chunk key")
+	}
+}
+
+func TestKeyWrongKey(t *testing.T) {
+	stream := encryptStream(t, keyWriter(testKey(t)), Options{}, []byte("wrong"))
+
+	_, err := NewReaderWithKey(bytes.NewReader(stream), testKey(t))
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+
+	// a keyed stream has no password
+	_, err = NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestKeyPasswordStream(t *testing.T) {
+	stream, _ := testChunks(t, 1)
+
+	_, err := NewReaderWithKey(bytes.NewReader(stream), testKey(t))
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestKeyLegacyStream(t *testing.T) {
+	_, err := NewReaderWithKey(bytes.NewReader(make([]byte, 1024)), testKey(t))
+	if err != ErrBadHeader {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadHeader)
+	}
+}
+
+func TestKeyNil(t *testing.T) {
+	_, err := NewWriterWithKey(ioutil.Discard, nil)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+
+	stream := encryptStream(t, keyWriter(testKey(t)), Options{}, []byte("nil"))
+	_, err = NewReaderWithKey(bytes.NewReader(stream), nil)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	kdf := Argon2Params{CostTime: 1, CostMemory: 8 * 1024, CostThreads: 1}
+	salt := randomSalt(t)
+
+	key, err := DeriveKey("password", salt, kdf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the same password, salt and KDF give the same key
+	again, err := DeriveKey("password", salt, kdf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stream := encryptStream(t, keyWriter(key), Options{}, []byte("derived"))
+	out, err := NewReaderWithKey(bytes.NewReader(stream), again)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	b, err := ioutil.ReadAll(out)
+	if err != nil || string(b) != "derived" {
+		t.Errorf("unexpected read %q error: %v", b, err)
+	}
+}
+
+func TestDeriveKeyInvalid(t *testing.T) {
+	kdf := Argon2Params{CostTime: 1, CostMemory: 8 * 1024, CostThreads: 1}
+
+	_, err := DeriveKey("pass", randomSalt(t), kdf)
+	if err != ErrUnsafe {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsafe)
+	}
+
+	_, err = DeriveKey("password", make([]byte, SaltLength), kdf)
+	if err != ErrUnsafe {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsafe)
+	}
+
+	_, err = DeriveKey("password", randomSalt(t), nil)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
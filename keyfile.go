@@ -0,0 +1,280 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+//
+//
+// KEY FILES
+//
+//
+
+// A key file holds a 32 bytes master key (see NewWriterWithKey), an
+// X25519 identity (see NewReaderWithIdentity) or an Ed25519 signing key seed
+// (see Options.Signer) as text, lines starting with '#' are comments and the
+// key is on a single line:
+//
+//	naclpipe-key-v1 <key> <checksum>
+//	naclpipe-key-v1-protected <key> <checksum>
+//	naclpipe-identity-v1 <key> <checksum>
+//	naclpipe-identity-v1-protected <key> <checksum>
+//	naclpipe-signing-v1 <key> <checksum>
+//	naclpipe-signing-v1-protected <key> <checksum>
+//
+// the key is standard base64, either the raw key or, for a passphrase
+// protected file, the naclpipe stream of the key encrypted with the
+// passphrase. The checksum is the hex of the first 4 bytes of the SHA-256
+// of the type and key fields separated by a space, it catches copy and
+// paste mistakes, not tampering.
+// Identity and signing key files have a comment with the public key in
+// standard base64.
+const (
+	keyFileType      = "naclpipe-key-v1"
+	identityFileType = "naclpipe-identity-v1"
+	signingFileType  = "naclpipe-signing-v1"
+	protectedSuffix  = "-protected"
+	keyFileChecksum  = 4
+)
+
+// GenerateKey returns a random 32 bytes master key.
+func GenerateKey() (*[32]byte, error) {
+	key := new([32]byte)
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyFileSum returns the checksum of a key line.
+func keyFileSum(typ, key string) string {
+	sum := sha256.Sum256([]byte(typ + " " + key))
+	return hex.EncodeToString(sum[:keyFileChecksum])
+}
+
+// WriteKeyFile writes 'key' to 'w' in the key file format, protected by
+// 'passphrase' unless it is empty.
+func WriteKeyFile(w io.Writer, key *[32]byte, passphrase string) error {
+	return writeKeyFile(w, keyFileType, "naclpipe key file, keep it secret", key, passphrase)
+}
+
+// WriteIdentityFile writes the X25519 'identity' to 'w' in the key file
+// format, protected by 'passphrase' unless it is empty.
+func WriteIdentityFile(w io.Writer, identity *[32]byte, passphrase string) error {
+	var publicKey [32]byte
+	curve25519.ScalarBaseMult(&publicKey, identity)
+	return writeKeyFile(w, identityFileType, "naclpipe identity file, keep it secret\n# public key: "+base64.StdEncoding.EncodeToString(publicKey[:]), identity, passphrase)
+}
+
+// WriteSigningKeyFile writes the seed of the Ed25519 'signer' to 'w' in the
+// key file format, protected by 'passphrase' unless it is empty.
+func WriteSigningKeyFile(w io.Writer, signer ed25519.PrivateKey, passphrase string) error {
+	if len(signer) != ed25519.PrivateKeySize {
+		return ErrUnsupported
+	}
+	seed := new([32]byte)
+	defer wipe(seed[:])
+	copy(seed[:], signer.Seed())
+	return writeKeyFile(w, signingFileType, "naclpipe signing key file, keep it secret\n# public key: "+base64.StdEncoding.EncodeToString(signer.Public().(ed25519.PublicKey)), seed, passphrase)
+}
+
+// writeKeyFile writes a 'typ' key file with a 'comment'.
+func writeKeyFile(w io.Writer, typ, comment string, key *[32]byte, passphrase string) error {
+	payload := key[:]
+
+	if len(passphrase) > 0 {
+		sealed := new(bytes.Buffer)
+		cw, err := NewWriter(sealed, passphrase, DerivateArgon2id)
+		if err != nil {
+			return err
+		}
+		_, err = cw.Write(key[:])
+		if err != nil {
+			return err
+		}
+		err = cw.Close()
+		if err != nil {
+			return err
+		}
+		typ, payload = typ+protectedSuffix, sealed.Bytes()
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	_, err := io.WriteString(w, "# "+comment+"\n"+typ+" "+encoded+" "+keyFileSum(typ, encoded)+"\n")
+	if err != nil {
+		return &WriteError{Err: err}
+	}
+	return nil
+}
+
+// ReadKeyFile reads a key file from 'r', 'passphrase' decrypts protected
+// key files. It returns ErrBadKeyFile for a malformed file or a checksum
+// mismatch and ErrWrongKey for a wrong (or missing) passphrase.
+func ReadKeyFile(r io.Reader, passphrase string) (*[32]byte, error) {
+	return readKeyFile(r, keyFileType, passphrase)
+}
+
+// ReadIdentityFile reads an identity file from 'r', see ReadKeyFile.
+func ReadIdentityFile(r io.Reader, passphrase string) (*[32]byte, error) {
+	return readKeyFile(r, identityFileType, passphrase)
+}
+
+// ReadSigningKeyFile reads a signing key file from 'r', see ReadKeyFile.
+func ReadSigningKeyFile(r io.Reader, passphrase string) (ed25519.PrivateKey, error) {
+	seed, err := readKeyFile(r, signingFileType, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(seed[:])
+	return ed25519.NewKeyFromSeed(seed[:]), nil
+}
+
+// readKeyFile reads a 'typ' key file.
+func readKeyFile(r io.Reader, typ string, passphrase string) (*[32]byte, error) {
+	var fields []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields != nil {
+			return nil, ErrBadKeyFile
+		}
+		fields = strings.Fields(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(fields) != 3 || keyFileSum(fields[0], fields[1]) != fields[2] {
+		return nil, ErrBadKeyFile
+	}
+	payload, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, ErrBadKeyFile
+	}
+
+	switch fields[0] {
+	case typ:
+	case typ + protectedSuffix:
+		if len(passphrase) == 0 {
+			return nil, ErrWrongKey
+		}
+		if bytes.HasPrefix(payload, []byte(headerMagic)) != true {
+			return nil, ErrBadKeyFile
+		}
+		cr, err := NewReader(bytes.NewReader(payload), passphrase, DerivateArgon2id)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := ioutil.ReadAll(cr)
+		wipe(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = plain
+	default:
+		return nil, ErrBadKeyFile
+	}
+
+	if len(payload) != keyLength {
+		wipe(payload)
+		return nil, ErrBadKeyFile
+	}
+	key := new([32]byte)
+	copy(key[:], payload)
+	wipe(payload)
+	return key, nil
+}
+
+// LoadKeyFile reads the key file at 'path', see ReadKeyFile.
+// Example:
+//	key, err := naclpipe.LoadKeyFile("key.np", "")
+//	if err != nil {
+//		return err
+//	}
+//	cryptoReader, err := naclpipe.NewReaderWithKey(os.Stdin, key)
+func LoadKeyFile(path, passphrase string) (*[32]byte, error) {
+	return loadKeyFile(path, keyFileType, passphrase)
+}
+
+// LoadIdentityFile reads the identity file at 'path', see ReadKeyFile.
+func LoadIdentityFile(path, passphrase string) (*[32]byte, error) {
+	return loadKeyFile(path, identityFileType, passphrase)
+}
+
+// LoadSigningKeyFile reads the signing key file at 'path', see ReadKeyFile.
+func LoadSigningKeyFile(path, passphrase string) (ed25519.PrivateKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSigningKeyFile(f, passphrase)
+}
+
+// loadKeyFile reads the 'typ' key file at 'path'.
+func loadKeyFile(path, typ, passphrase string) (*[32]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readKeyFile(f, typ, passphrase)
+}
+
+// SaveKeyFile creates the key file at 'path', readable by its owner only,
+// it does not overwrite an existing file.
+func SaveKeyFile(path string, key *[32]byte, passphrase string) error {
+	return saveKeyFile(path, func(w io.Writer) error {
+		return WriteKeyFile(w, key, passphrase)
+	})
+}
+
+// SaveIdentityFile creates the identity file at 'path', see SaveKeyFile.
+func SaveIdentityFile(path string, identity *[32]byte, passphrase string) error {
+	return saveKeyFile(path, func(w io.Writer) error {
+		return WriteIdentityFile(w, identity, passphrase)
+	})
+}
+
+// SaveSigningKeyFile creates the signing key file at 'path', see SaveKeyFile.
+func SaveSigningKeyFile(path string, signer ed25519.PrivateKey, passphrase string) error {
+	return saveKeyFile(path, func(w io.Writer) error {
+		return WriteSigningKeyFile(w, signer, passphrase)
+	})
+}
+
+// saveKeyFile creates 'path' with the owner permissions and writes it with 'write'.
+func saveKeyFile(path string, write func(w io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = &WriteError{Err: cerr}
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ *
+ *
+ *
+ *
+ * KEY FILE TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, passphrase := range []string{"", "passphrase"} {
+		iobuf := new(bytes.Buffer)
+		err = WriteKeyFile(iobuf, key, passphrase)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		out, err := ReadKeyFile(iobuf, passphrase)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if *out != *key {
+			t.Errorf("keys do not match")
+		}
+	}
+}
+
+func TestKeyFileProtected(t *testing.T) {
+	key := testKey(t)
+	iobuf := new(bytes.Buffer)
+	err := WriteKeyFile(iobuf, key, "passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if strings.Contains(iobuf.String(), keyFileType+protectedSuffix+" ") != true {
+		t.Errorf("unexpected key file %q", iobuf.String())
+	}
+
+	for _, passphrase := range []string{"", "wrongpassphrase"} {
+		_, err = ReadKeyFile(bytes.NewReader(iobuf.Bytes()), passphrase)
+		if err != ErrWrongKey {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+		}
+	}
+}
+
+func TestKeyFileBad(t *testing.T) {
+	iobuf := new(bytes.Buffer)
+	err := WriteKeyFile(iobuf, testKey(t), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	good := iobuf.String()
+	line := strings.Split(good, "\n")[1]
+	fields := strings.Fields(line)
+
+	for _, bad := range []string{
+		"",
+		"# only a comment\n",
+		// a typo in the key
+		strings.Replace(good, fields[1][:4], "AAAA", 1),
+		// a typo in the checksum
+		strings.Replace(good, fields[2], "00000000", 1),
+		// two keys
+		good + line + "\n",
+		// unknown type
+		"naclpipe-key-v9 " + fields[1] + " " + keyFileSum("naclpipe-key-v9", fields[1]) + "\n",
+		// short key
+		keyFileType + " AAAA " + keyFileSum(keyFileType, "AAAA") + "\n",
+	} {
+		_, err = ReadKeyFile(strings.NewReader(bad), "")
+		if err != ErrBadKeyFile {
+			t.Errorf("unexpected error: %v (vs %v) for %q", err, ErrBadKeyFile, bad)
+		}
+	}
+}
+
+func TestKeyFileSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naclpipe")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.np")
+
+	key := testKey(t)
+	err = SaveKeyFile(path, key, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected key file mode %v", fi.Mode())
+	}
+
+	out, err := LoadKeyFile(path, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *out != *key {
+		t.Errorf("keys do not match")
+	}
+
+	// an existing key is never overwritten
+	err = SaveKeyFile(path, testKey(t), "")
+	if os.IsExist(err) != true {
+		t.Errorf("unexpected error: %v (vs file exists)", err)
+	}
+}
+
+func TestIdentityFile(t *testing.T) {
+	publicKey, identity := testIdentity(t)
+
+	iobuf := new(bytes.Buffer)
+	err := WriteIdentityFile(iobuf, identity, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the public key is in a comment
+	if strings.Contains(iobuf.String(), "# public key: "+base64.StdEncoding.EncodeToString(publicKey[:])+"\n") != true {
+		t.Errorf("unexpected identity file %q", iobuf.String())
+	}
+
+	out, err := ReadIdentityFile(bytes.NewReader(iobuf.Bytes()), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *out != *identity {
+		t.Errorf("identities do not match")
+	}
+
+	// an identity is not a key
+	_, err = ReadKeyFile(bytes.NewReader(iobuf.Bytes()), "")
+	if err != ErrBadKeyFile {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadKeyFile)
+	}
+}
+
+func TestSigningKeyFile(t *testing.T) {
+	publicKey, signer := testSigner(t)
+
+	iobuf := new(bytes.Buffer)
+	err := WriteSigningKeyFile(iobuf, signer, "passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the public key is in a comment
+	if strings.Contains(iobuf.String(), "# public key: "+base64.StdEncoding.EncodeToString(publicKey)+"\n") != true {
+		t.Errorf("unexpected signing key file %q", iobuf.String())
+	}
+
+	out, err := ReadSigningKeyFile(bytes.NewReader(iobuf.Bytes()), "passphrase")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(out, signer) != true {
+		t.Errorf("signing keys do not match")
+	}
+
+	// a signing key is not an identity
+	_, err = ReadIdentityFile(bytes.NewReader(iobuf.Bytes()), "passphrase")
+	if err != ErrBadKeyFile {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadKeyFile)
+	}
+}
@@ -0,0 +1,116 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+)
+
+//
+//
+// LEGACY
+//
+//
+
+const (
+	// v0.1.x scrypt parameters, only used with DerivateScrypt010
+	oldScryptCostParam = 16384
+	oldScryptCostN     = 8
+	oldScryptCostP     = 1
+
+	// DefaultLegacyChunkSize is the chunk size of legacy headerless streams
+	// written by np with its default buffer size.
+	DefaultLegacyChunkSize = 4194304
+)
+
+// legacyReader decodes the headerless v0.2 streams: the raw salt followed by
+// secretbox chunks of chunkSize bytes sealed with the shazam() nonces, only
+// the last chunk is shorter and nothing authenticates the end of the stream.
+type legacyReader struct {
+	NaclPipe
+}
+
+// shazam function does an SHA3 on the counter and update the counter/Nonce value generated.
+// stream operate in blocks, then each blocks will be encrypted with its nonce.
+// it is the v0.2 headerless stream nonce, only kept to decode legacy streams.
+func (c *NaclPipe) shazam() {
+	out := sha3.Sum256([]byte(fmt.Sprintf("%d", c.cnt)))
+	copy(c.cntNonce[:], out[:24])
+	return
+}
+
+func (c *legacyReader) initReader(r io.Reader, password string) (err error) {
+	// we read the salt immediately
+	_, err = io.ReadFull(r, c.salt)
+	if err != nil {
+		return
+	}
+	c.offset = int64(len(c.salt))
+
+	/* let's derive a key */
+	err = c.deriveKey(c.salt, password)
+	if err != nil {
+		return
+	}
+	c.rd = r
+	return
+}
+
+// readChunk reads the next fixed size chunk and opens it.
+func (c *legacyReader) readChunk() (err error) {
+	b := make([]byte, int(c.chunkSize)+secretbox.Overhead)
+
+	n, err := io.ReadFull(c.rd, b)
+	switch err {
+	case io.ErrUnexpectedEOF:
+		// a short chunk is the last one
+		c.final = true
+	case nil:
+	default:
+		// io.EOF on a chunk boundary
+		return
+	}
+
+	c.shazam()
+	pt, res := secretbox.Open(nil, b[:n], c.cntNonce, c.dKey)
+	if res != true {
+		// the first chunk is the only key check of a legacy stream
+		if c.cnt == 0 {
+			return ErrWrongKey
+		}
+		return &AuthError{Chunk: c.cnt, Offset: c.offset}
+	}
+	c.cnt++
+	c.offset += int64(n)
+	c.pt = pt
+	return nil
+}
+
+// Read decrypts up to len(p) bytes into p.
+func (c *legacyReader) Read(p []byte) (n int, err error) {
+	switch {
+	case c.err != nil:
+		return 0, c.err
+	case len(p) == 0:
+		return 0, nil
+	}
+
+	for len(c.pt) == 0 {
+		if c.final {
+			return 0, io.EOF
+		}
+		err = c.readChunk()
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+
+	n = copy(p, c.pt)
+	c.pt = c.pt[n:]
+	return n, nil
+}
@@ -0,0 +1,192 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// legacyStream encrypts 'b' the way v0.2 writers did: the raw salt followed
+// by secretbox chunks of 'chunkSize' bytes sealed with the shazam() nonces.
+func legacyStream(t *testing.T, b []byte, derivation int, chunkSize int) []byte {
+	c := new(NaclPipe)
+	c.initialize(derivation)
+
+	_, err := rand.Read(c.salt)
+	if err != nil {
+		t.Fatalf("salt error: %v", err)
+	}
+
+	err = c.deriveKey(c.salt, "password")
+	if err != nil {
+		t.Fatalf("derivation error: %v", err)
+	}
+
+	out := append([]byte(nil), c.salt...)
+	for len(b) > 0 {
+		n := chunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+
+		c.shazam()
+		out = secretbox.Seal(out, b[:n], c.cntNonce, c.dKey)
+		c.cnt++
+		b = b[n:]
+	}
+	return out
+}
+
+/*
+ *
+ *
+ *
+ *
+ * LEGACY TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestLegacyRead(t *testing.T) {
+	b := make([]byte, 3*DefaultLegacyChunkSize/2)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+
+	cr, err := NewReader(bytes.NewReader(legacyStream(t, b, DerivateScrypt010, DefaultLegacyChunkSize)), "password", DerivateScrypt010)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	if cr.Format() != FormatLegacy {
+		t.Errorf("unexpected format %d vs %d", cr.Format(), FormatLegacy)
+	}
+
+	out := new(bytes.Buffer)
+	_, err = io.Copy(out, cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if bytes.Equal(b, out.Bytes()) != true {
+		t.Fatalf("data do not match")
+	}
+}
+
+func TestLegacyReadSize(t *testing.T) {
+	chunkSize := 1000
+
+	// the last chunk is a full one
+	b := make([]byte, 4*chunkSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+
+	cr, err := NewReaderSize(bytes.NewReader(legacyStream(t, b, DerivateScrypt010, chunkSize)), "password", DerivateScrypt010, chunkSize)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	out := new(bytes.Buffer)
+	_, err = io.Copy(out, cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if bytes.Equal(b, out.Bytes()) != true {
+		t.Fatalf("data do not match")
+	}
+}
+
+func TestLegacyReadWrongSize(t *testing.T) {
+	chunkSize := 1000
+	b := make([]byte, 4*chunkSize)
+
+	cr, err := NewReaderSize(bytes.NewReader(legacyStream(t, b, DerivateScrypt010, chunkSize)), "password", DerivateScrypt010, chunkSize/2)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	// nothing tells a wrong chunk size from a wrong key
+	_, err = io.Copy(ioutil.Discard, cr)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestLegacyReadSizeInvalid(t *testing.T) {
+	_, err := NewReaderSize(rand.Reader, "password", DerivateScrypt010, 0)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestLegacyFormatDetection(t *testing.T) {
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF}, nil)
+
+	// the derivation is only used for legacy streams
+	cr, err := NewReader(bytes.NewReader(stream), "password", DerivateScrypt010)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	if cr.Format() != FormatV1 {
+		t.Errorf("unexpected format %d vs %d", cr.Format(), FormatV1)
+	}
+}
+
+func TestNewWriterLegacyDerivation(t *testing.T) {
+	_, err := NewWriter(ioutil.Discard, "password", DerivateScrypt010)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestLegacyReadCorrupted(t *testing.T) {
+	chunkSize := 1000
+	stream := legacyStream(t, make([]byte, 4*chunkSize), DerivateScrypt010, chunkSize)
+	offset := OldSaltLength + 2*(chunkSize+secretbox.Overhead)
+	stream[offset+10] ^= 0x01
+
+	cr, err := NewReaderSize(bytes.NewReader(stream), "password", DerivateScrypt010, chunkSize)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	_, err = io.Copy(ioutil.Discard, cr)
+	if ae, ok := err.(*AuthError); ok != true || ae.Chunk != 2 || ae.Offset != int64(offset) {
+		t.Errorf("unexpected error: %v (vs AuthError)", err)
+	}
+
+	// the next chunk is not read past the broken one
+	n, again := cr.Read(make([]byte, chunkSize))
+	if again != err || n != 0 {
+		t.Errorf("unexpected error: %v (vs %v) n: %d", again, err, n)
+	}
+}
+
+func TestLegacyRequireCommitment(t *testing.T) {
+	stream := legacyStream(t, []byte("uncommitted"), DerivateScrypt010, DefaultLegacyChunkSize)
+
+	// legacy streams commit to no key
+	_, err := NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{Derivation: DerivateScrypt010, RequireCommitment: true})
+	if err != ErrUnsupportedVersion {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupportedVersion)
+	}
+
+	stream = encryptStream(t, keyWriter(testKey(t)), Options{}, nil)
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{RequireCommitment: true})
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
@@ -0,0 +1,225 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+//
+// METADATA
+//
+//
+
+// Metadata describes the plaintext of a stream (see Options.Metadata), it is
+// encrypted in the metadata extension of the header:
+//
+//	siv        [24]byte  HMAC-SHA256 of the entries with a metadata subkey
+//	sealed     []byte    secretbox of the entries with the siv as nonce
+//
+// the entries are sorted by key, each is a key and a value both prefixed by
+// their uint16 length. The key check authenticates the sealed block, the
+// synthetic nonce keeps it safe in deterministic streams and Rewrap keeps it
+// as is. Its length is not hidden.
+type Metadata map[string]string
+
+// Metadata standard keys, see FileMetadata.
+const (
+	// MetadataName is the base name of the original file.
+	MetadataName = "name"
+	// MetadataMode is the permission bits of the original file, in octal.
+	MetadataMode = "mode"
+	// MetadataModTime is the modification time of the original file, RFC 3339.
+	MetadataModTime = "mtime"
+	// MetadataContentType is the MIME type of the plaintext.
+	MetadataContentType = "content-type"
+	// MetadataSize is the size of the plaintext in bytes, in decimal.
+	MetadataSize = "size"
+)
+
+const hkdfInfoMetadata = "naclpipe metadata key"
+
+// FileMetadata returns the name, mode, modification time and size of the
+// file 'fi' as Metadata.
+// Example:
+//	fi, err := f.Stat()
+//	if err != nil {
+//		return err
+//	}
+//	cryptoWriter, err := naclpipe.NewWriterWithOptions(os.Stdout, "mypassword", naclpipe.Options{
+//		Metadata: naclpipe.FileMetadata(fi),
+//	})
+func FileMetadata(fi os.FileInfo) Metadata {
+	return Metadata{
+		MetadataName:    fi.Name(),
+		MetadataMode:    fmt.Sprintf("%#o", uint32(fi.Mode().Perm())),
+		MetadataModTime: fi.ModTime().UTC().Format(time.RFC3339Nano),
+		MetadataSize:    strconv.FormatInt(fi.Size(), 10),
+	}
+}
+
+// Mode returns the permission bits of MetadataMode, if any.
+func (m Metadata) Mode() (os.FileMode, bool) {
+	mode, err := strconv.ParseUint(m[MetadataMode], 8, 32)
+	if err != nil {
+		return 0, false
+	}
+	return os.FileMode(mode) & os.ModePerm, true
+}
+
+// ModTime returns the time of MetadataModTime, if any.
+func (m Metadata) ModTime() (time.Time, bool) {
+	mtime, err := time.Parse(time.RFC3339Nano, m[MetadataModTime])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return mtime, true
+}
+
+// Size returns the size of MetadataSize, if any.
+func (m Metadata) Size() (int64, bool) {
+	size, err := strconv.ParseInt(m[MetadataSize], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// marshal serializes the metadata entries sorted by key.
+func (m Metadata) marshal() ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	for _, k := range keys {
+		v := m[k]
+		if len(k) == 0 || len(k) > math.MaxUint16 || len(v) > math.MaxUint16 {
+			return nil, ErrUnsupported
+		}
+		b = append(b, byte(len(k)>>8), byte(len(k)))
+		b = append(b, k...)
+		b = append(b, byte(len(v)>>8), byte(len(v)))
+		b = append(b, v...)
+	}
+	return b, nil
+}
+
+// unmarshalMetadata decodes the metadata entries, sorted and unique.
+func unmarshalMetadata(b []byte) (Metadata, error) {
+	m := make(Metadata)
+	var last string
+	for len(b) > 0 {
+		var entry [2]string
+		for i := range entry {
+			if len(b) < 2 {
+				return nil, ErrBadHeader
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			if len(b) < 2+n {
+				return nil, ErrBadHeader
+			}
+			entry[i] = string(b[2 : 2+n])
+			b = b[2+n:]
+		}
+		if len(entry[0]) == 0 || (len(m) > 0 && entry[0] <= last) {
+			return nil, ErrBadHeader
+		}
+		m[entry[0]] = entry[1]
+		last = entry[0]
+	}
+	return m, nil
+}
+
+// metadataKeys derives the metadata secretbox and siv keys from the key.
+func (c *NaclPipe) metadataKeys() (*[32]byte, []byte, error) {
+	var keys [64]byte
+	defer wipe(keys[:])
+	_, err := io.ReadFull(hkdf.New(sha256.New, c.dKey[:], c.salt, []byte(hkdfInfoMetadata)), keys[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sKey := new([32]byte)
+	copy(sKey[:], keys[:32])
+	return sKey, append([]byte(nil), keys[32:]...), nil
+}
+
+// metadataSIV returns the synthetic nonce of the metadata entries 'b'.
+func metadataSIV(macKey, b []byte) *[24]byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(b)
+	siv := new([24]byte)
+	copy(siv[:], mac.Sum(nil))
+	return siv
+}
+
+// sealMetadata returns the sealed metadata extension of 'm', nil without
+// metadata.
+func (c *NaclPipe) sealMetadata(m Metadata) ([]byte, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	b, err := m.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	sKey, macKey, err := c.metadataKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(sKey[:])
+	defer wipe(macKey)
+
+	siv := metadataSIV(macKey, b)
+	return secretbox.Seal(siv[:], b, siv, sKey), nil
+}
+
+// openMetadata opens the sealed metadata extension 'sealed', the key check
+// authenticated it already.
+func (c *NaclPipe) openMetadata(sealed []byte) (Metadata, error) {
+	if sealed == nil {
+		return nil, nil
+	}
+
+	sKey, macKey, err := c.metadataKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(sKey[:])
+	defer wipe(macKey)
+
+	siv := new([24]byte)
+	copy(siv[:], sealed)
+	b, ok := secretbox.Open(nil, sealed[len(siv):], siv, sKey)
+	if ok != true || hmac.Equal(siv[:], metadataSIV(macKey, b)[:]) != true {
+		return nil, ErrBadHeader
+	}
+	return unmarshalMetadata(b)
+}
+
+// Metadata returns the decrypted metadata of the stream, nil for streams
+// without (see Options.Metadata).
+func (r *Reader) Metadata() Metadata {
+	c, ok := r.rd.(*NaclPipe)
+	if ok != true {
+		return nil
+	}
+	return c.metadata
+}
@@ -0,0 +1,195 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ *
+ *
+ *
+ *
+ * METADATA TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestMetadataRoundTrip(t *testing.T) {
+	m := Metadata{
+		MetadataName:        "backup.tar",
+		MetadataContentType: "application/x-tar",
+		"owner":             "ops",
+		"empty":             "",
+	}
+	b := []byte("backup")
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, Metadata: m}, b)
+
+	// the metadata is encrypted
+	if bytes.Contains(stream, []byte("backup.tar")) == true {
+		t.Errorf("metadata in the clear")
+	}
+
+	cr, err := NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	if reflect.DeepEqual(cr.Metadata(), m) != true {
+		t.Errorf("unexpected metadata %v (vs %v)", cr.Metadata(), m)
+	}
+	out, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(b, out) != true {
+		t.Fatalf("data do not match")
+	}
+
+	// streams without metadata have none
+	stream = encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF}, b)
+	cr, err = NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	if cr.Metadata() != nil || cr.Format() != FormatV1 {
+		t.Errorf("unexpected metadata %v format %d", cr.Metadata(), cr.Format())
+	}
+}
+
+func TestMetadataTampered(t *testing.T) {
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, Metadata: Metadata{MetadataName: "backup.tar"}}, nil)
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the sealed metadata is covered by the key check
+	stream[len(h.raw)-1] ^= 0x01
+	_, err = NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestMetadataDeterministic(t *testing.T) {
+	key := testKey(t)
+
+	var streams [][]byte
+	for _, name := range []string{"a.tar", "a.tar", "b.tar"} {
+		opts := Options{Deterministic: true, Metadata: Metadata{MetadataName: name}}
+		streams = append(streams, encryptStream(t, keyWriter(key), opts, nil))
+	}
+	if bytes.Equal(streams[0], streams[1]) != true || bytes.Equal(streams[0], streams[2]) == true {
+		t.Errorf("unexpected deterministic metadata")
+	}
+
+	cr, err := NewReaderWithKey(bytes.NewReader(streams[2]), key)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	if cr.Metadata()[MetadataName] != "b.tar" {
+		t.Errorf("unexpected metadata %v", cr.Metadata())
+	}
+}
+
+func TestMetadataInvalid(t *testing.T) {
+	for _, m := range []Metadata{
+		{"": "no key"},
+		{MetadataName: strings.Repeat("x", 64*1024)},
+	} {
+		_, err := NewWriterWithOptions(ioutil.Discard, "password", Options{KDF: cheapKDF, Metadata: m})
+		if err != ErrUnsupported {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+		}
+	}
+
+	for _, b := range [][]byte{
+		{0},
+		{0, 1, 'a', 0},
+		// unsorted
+		{0, 1, 'b', 0, 0, 0, 1, 'a', 0, 0},
+		// duplicated
+		{0, 1, 'a', 0, 0, 0, 1, 'a', 0, 0},
+		// empty key
+		{0, 0, 0, 0},
+	} {
+		_, err := unmarshalMetadata(b)
+		if err != ErrBadHeader {
+			t.Errorf("unexpected error: %v (vs %v) for %v", err, ErrBadHeader, b)
+		}
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "naclpipe")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.tar")
+
+	err = ioutil.WriteFile(path, []byte("backup"), 0640)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mtime := time.Date(2018, 11, 17, 12, 30, 0, 5, time.UTC)
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := FileMetadata(fi)
+	if m[MetadataName] != "backup.tar" || m[MetadataMode] != "0640" {
+		t.Errorf("unexpected metadata %v", m)
+	}
+	mode, ok := m.Mode()
+	if ok != true || mode != fi.Mode().Perm() {
+		t.Errorf("unexpected mode %v (vs %v)", mode, fi.Mode().Perm())
+	}
+	modTime, ok := m.ModTime()
+	if ok != true || modTime.Equal(fi.ModTime()) != true {
+		t.Errorf("unexpected modification time %v (vs %v)", modTime, fi.ModTime())
+	}
+	size, ok := m.Size()
+	if ok != true || size != 6 {
+		t.Errorf("unexpected size %d", size)
+	}
+
+	_, ok = Metadata{}.Mode()
+	if ok == true {
+		t.Errorf("unexpected mode")
+	}
+}
+
+func TestMetadataRewrap(t *testing.T) {
+	m := Metadata{MetadataName: "backup.tar"}
+	stream := encryptStream(t, envelopeWriter(PasswordRecipient("password", cheapKDF)), Options{Metadata: m}, nil)
+
+	out := new(bytes.Buffer)
+	err := RewrapTo(out, bytes.NewReader(stream), PasswordCredential("password"), PasswordRecipient("n3wp4ssw0rd", cheapKDF))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cr, err := NewReader(bytes.NewReader(out.Bytes()), "n3wp4ssw0rd", DerivateArgon2id)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	if reflect.DeepEqual(cr.Metadata(), m) != true {
+		t.Errorf("unexpected metadata %v (vs %v)", cr.Metadata(), m)
+	}
+}
@@ -0,0 +1,204 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"io"
+	"math"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+//
+// OPTIONS
+//
+//
+
+// Options configures a Writer created with NewWriterWithOptions, the zero
+// value writes the same stream as NewWriter with DerivateArgon2id.
+type Options struct {
+	// KDF derives the key with its cost parameters, they are recorded in
+	// the stream header and readers use them, nil uses the default Argon2id
+	// costs. The KDF must be registered (see RegisterKDF) and its costs
+	// within its own limits (see KDF.Limits), or ErrKDFLimits is returned:
+	// a stream readers only decrypt with raised ReaderOptions limits is
+	// never written.
+	KDF KDF
+	// ChunkSize is the plaintext size of a chunk, up to MaxChunkSize, zero
+	// uses DefaultChunkSize.
+	ChunkSize int
+	// CipherSuite is the AEAD of the chunks, recorded in the stream header,
+	// the zero value is SuiteSecretbox.
+	CipherSuite CipherSuite
+	// Signer signs the stream with Ed25519, readers check the signature at
+	// the end of the stream (see ReaderOptions.TrustedSigners), nil does
+	// not sign.
+	Signer ed25519.PrivateKey
+	// Deterministic derives the salt from the key and each chunk nonce from
+	// the chunk position and plaintext, the same key and plaintext always
+	// give the same stream and a repeated chunk at the same position the
+	// same sealed chunk. It reveals which chunks are equal and only keyed
+	// streams (see NewWriterWithKeyOptions) with SuiteSecretbox or
+	// SuiteXChaCha20Poly1305 support it, Flush changes the chunk boundaries
+	// and the stream.
+	Deterministic bool
+	// AssociatedData binds the stream to its context (an object path, a
+	// tenant...), readers need the same data (see ReaderOptions) and any
+	// other fails with ErrContextMismatch. It is authenticated but neither
+	// encrypted nor stored in the stream, nil binds nothing.
+	AssociatedData []byte
+	// Metadata describes the plaintext (see FileMetadata), it is encrypted
+	// in the header and readers get it with Reader.Metadata, the header
+	// extensions are at most 64 KiB.
+	Metadata Metadata
+}
+
+// setOptions applies the writer options of 'opts' but the KDF to the pipe.
+func (c *NaclPipe) setOptions(opts Options) error {
+	if opts.CipherSuite.valid() != true {
+		return ErrUnsupported
+	}
+	c.suite = opts.CipherSuite
+	if opts.ChunkSize != 0 {
+		if opts.ChunkSize < 0 || opts.ChunkSize > MaxChunkSize {
+			return ErrUnsupported
+		}
+		c.chunkSize = uint32(opts.ChunkSize)
+	}
+	if opts.Signer != nil {
+		if len(opts.Signer) != ed25519.PrivateKeySize {
+			return ErrUnsupported
+		}
+		c.signer = opts.Signer
+	}
+	// every deterministic stream of a key shares its chunk key, the 96-bit
+	// GCM nonces of their sivs could collide
+	if opts.Deterministic && opts.CipherSuite == SuiteAES256GCM {
+		return ErrUnsupported
+	}
+	c.determinism = opts.Deterministic
+	c.context = opts.AssociatedData
+	c.metadata = opts.Metadata
+	return nil
+}
+
+// NewWriterWithOptions initialize an io.WriteCloser using 'password' and the
+// key derivation and chunk size of 'opts', Close() must be called to
+// terminate the stream.
+// Example:
+//	cryptoWriter, err := naclpipe.NewWriterWithOptions(os.Stdout, "mypassword", naclpipe.Options{
+//		KDF: naclpipe.Argon2Params{CostTime: 4, CostMemory: 64 * 1024, CostThreads: 2},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer cryptoWriter.Close()
+func NewWriterWithOptions(w io.Writer, password string, opts Options) (*Writer, error) {
+	return newCryptoWriter(w, password, DerivateArgon2id, opts)
+}
+
+// default key derivation limits of scrypt and Argon2id (see KDF.Limits)
+const (
+	// DefaultMaxKDFMemory is the largest key derivation memory, in bytes, a
+	// reader accepts from a stream header.
+	DefaultMaxKDFMemory = 1024 * 1024 * 1024
+	// DefaultMaxKDFTime is the largest number of key derivation passes a
+	// reader accepts from a stream header.
+	DefaultMaxKDFTime = 32
+	// DefaultMinKDFMemory is the smallest key derivation memory, in bytes, a
+	// reader accepts from a stream header.
+	DefaultMinKDFMemory = 8 * 1024 * 1024
+	// DefaultMinKDFTime is the smallest number of key derivation passes a
+	// reader accepts from a stream header.
+	DefaultMinKDFTime = 1
+)
+
+// ReaderOptions configures a Reader created with NewReaderWithOptions, the
+// zero value reads like NewReader with DerivateArgon2id.
+//
+// The key derivation costs come from the stream header, readers check them
+// before deriving the key: a crafted header cannot exhaust the memory or
+// the time of the reader and a downgraded one cannot weaken the password
+// protection. Zero limits use the defaults of the function (see
+// KDF.Limits), others apply to every function.
+type ReaderOptions struct {
+	// Derivation decrypts legacy headerless streams, as NewReader.
+	Derivation int
+	// LegacyChunkSize is the chunk size of legacy headerless streams, as
+	// NewReaderSize, zero uses DefaultLegacyChunkSize.
+	LegacyChunkSize int
+
+	// MaxKDFMemory and MaxKDFTime are the largest memory (in bytes) and
+	// number of passes of a key derivation (see KDF.Cost), MaxKDFTime also
+	// bounds the passes of all the password slots an envelope reader tries.
+	MaxKDFMemory uint64
+	MaxKDFTime   uint64
+	// MinKDFMemory and MinKDFTime are the smallest memory (in bytes) and
+	// number of passes of a key derivation.
+	MinKDFMemory uint64
+	MinKDFTime   uint64
+
+	// TrustedSigners only accepts streams signed by one of these Ed25519
+	// public keys, others fail with ErrBadSignature, nil accepts unsigned
+	// streams. Signatures are checked at the end of the stream, its last
+	// chunk is only returned once it is verified.
+	TrustedSigners []ed25519.PublicKey
+
+	// RequireCommitment only reads streams committed to a single key (all
+	// but the legacy headerless ones, see ErrUnsupportedVersion), a service
+	// trying several candidate keys on untrusted streams should set it.
+	RequireCommitment bool
+
+	// AssociatedData is the context a stream was written with (see
+	// Options.AssociatedData), streams of any other context fail with
+	// ErrContextMismatch, nil only reads streams bound to no context.
+	AssociatedData []byte
+}
+
+// limit returns 'v' or its default 'd' when zero.
+func limit(v, d uint64) uint64 {
+	if v == 0 {
+		return d
+	}
+	return v
+}
+
+// checkKDF returns ErrKDFLimits if the costs of 'k' are out of the limits.
+func (o ReaderOptions) checkKDF(k KDF) error {
+	memory, passes := k.Cost()
+	d := k.Limits()
+
+	switch {
+	case memory > limit(o.MaxKDFMemory, d.MaxMemory):
+		return ErrKDFLimits
+	case passes > limit(o.MaxKDFTime, d.MaxTime):
+		return ErrKDFLimits
+	case memory < limit(o.MinKDFMemory, d.MinMemory):
+		return ErrKDFLimits
+	case passes < limit(o.MinKDFTime, d.MinTime):
+		return ErrKDFLimits
+	}
+	return nil
+}
+
+// NewReaderWithOptions initialize an io.Reader using 'password' and the
+// limits of 'opts', the key derivation function and its parameters are read
+// from the stream header.
+// Example:
+//	cryptoReader, err := naclpipe.NewReaderWithOptions(os.Stdin, "mypassword", naclpipe.ReaderOptions{
+//		MaxKDFMemory: 64 * 1024 * 1024,
+//	})
+//	if err != nil {
+//		return err
+//	}
+func NewReaderWithOptions(r io.Reader, password string, opts ReaderOptions) (*Reader, error) {
+	if opts.LegacyChunkSize == 0 {
+		opts.LegacyChunkSize = DefaultLegacyChunkSize
+	}
+	if opts.LegacyChunkSize < 0 || uint64(opts.LegacyChunkSize) > math.MaxUint32-secretbox.Overhead {
+		return nil, ErrUnsupported
+	}
+	return newCryptoReader(r, password, opts)
+}
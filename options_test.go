@@ -0,0 +1,205 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+// unregisteredKDF is a testKDF with an ID nobody registers.
+type unregisteredKDF struct {
+	testKDF
+}
+
+func (k unregisteredKDF) ID() uint8 {
+	return 201
+}
+
+// weakWriter returns a writer stretching 'password' with 'kdf' regardless
+// of the reader limits, as an older writer did.
+func weakWriter(t *testing.T, w io.Writer, password string, kdf KDF) *Writer {
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.kdf = kdf
+
+	err := c.initWriter(w, password)
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+	return &Writer{c: c, buf: make([]byte, 0, c.chunkSize)}
+}
+
+/*
+ *
+ *
+ *
+ *
+ * OPTIONS TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestWriterOptions(t *testing.T) {
+	kdf := Argon2Params{CostTime: 1, CostMemory: 8 * 1024, CostThreads: 1}
+	chunkSize := 100
+
+	b := make([]byte, 10*chunkSize+1)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: kdf, ChunkSize: chunkSize}, b)
+
+	// the reader honours the costs and chunk size of the header
+	cr, err := NewReader(bytes.NewReader(stream), "password", DerivateScrypt)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+
+	c := cr.rd.(*NaclPipe)
+	kdf.KeyLength = keyLength
+	if c.kdf != kdf || c.chunkSize != uint32(chunkSize) {
+		t.Errorf("unexpected kdf %v chunk size %d", c.kdf, c.chunkSize)
+	}
+
+	out, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(b, out) != true {
+		t.Fatalf("data do not match")
+	}
+}
+
+func TestWriterOptionsDefault(t *testing.T) {
+	cw, err := NewWriterWithOptions(ioutil.Discard, "password", Options{})
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+
+	d := new(NaclPipe)
+	d.initialize(DerivateArgon2id)
+	if cw.c.kdf != d.kdf || cw.c.chunkSize != DefaultChunkSize {
+		t.Errorf("unexpected kdf %v chunk size %d", cw.c.kdf, cw.c.chunkSize)
+	}
+}
+
+func TestWriterOptionsInvalid(t *testing.T) {
+	for _, opts := range []Options{
+		{ChunkSize: -1},
+		{ChunkSize: MaxChunkSize + 1},
+		// readers would not know it
+		{KDF: unregisteredKDF{}},
+		// argon2 needs a thread
+		{KDF: Argon2Params{CostTime: 1, CostMemory: 8 * 1024}},
+	} {
+		_, err := NewWriterWithOptions(ioutil.Discard, "password", opts)
+		if err != ErrUnsupported {
+			t.Errorf("unexpected error: %v (vs %v) with %v", err, ErrUnsupported, opts)
+		}
+	}
+}
+
+// limitStream returns a stream header using 'kdf', its key check is not
+// computed as the costs are checked before any derivation.
+func limitStream(t *testing.T, kdf KDF) io.Reader {
+	h := &header{
+		version:     formatVersion,
+		kdf:         kdf,
+		chunkSize:   DefaultChunkSize,
+		salt:        randomSalt(t),
+		noncePrefix: make([]byte, noncePrefixLength),
+	}
+	b, err := h.marshal()
+	if err != nil {
+		t.Fatalf("header marshal error: %v", err)
+	}
+	return bytes.NewReader(append(b, make([]byte, headerCheckLength)...))
+}
+
+func TestReaderKDFLimits(t *testing.T) {
+	for _, kdf := range []KDF{
+		// 4 TiB
+		Argon2Params{CostTime: 1, CostMemory: math.MaxUint32, CostThreads: 1},
+		Argon2Params{CostTime: 1000, CostMemory: 8 * 1024, CostThreads: 1},
+		ScryptParams{CostParam: 1 << 30, CostN: 16, CostP: 1},
+		ScryptParams{CostParam: math.MaxInt32, CostN: math.MaxInt32, CostP: math.MaxInt32},
+		// 8 GiB of 128 * r * p
+		ScryptParams{CostParam: 2, CostN: 1 << 22, CostP: 16},
+		ScryptParams{CostParam: 1024, CostN: scryptMaxR * 2, CostP: 1},
+		// downgraded
+		Argon2Params{CostTime: 1, CostMemory: 1024, CostThreads: 1},
+		ScryptParams{CostParam: 1024, CostN: 8, CostP: 1},
+	} {
+		_, err := NewReader(limitStream(t, kdf), "password", DerivateArgon2id)
+		if err != ErrKDFLimits {
+			t.Errorf("unexpected error: %v (vs %v) with %v", err, ErrKDFLimits, kdf)
+		}
+	}
+}
+
+func TestReaderOptionsLimits(t *testing.T) {
+	kdf := Argon2Params{CostTime: 1, CostMemory: 1024, CostThreads: 1}
+
+	iobuf := new(bytes.Buffer)
+	cw := weakWriter(t, iobuf, "password", kdf)
+	err := cw.Close()
+	if err != nil {
+		t.Fatalf("crypto writer close error: %v", err)
+	}
+	stream := iobuf.Bytes()
+
+	// 1 MiB is below the default floor
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{})
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{MinKDFMemory: 1024 * 1024})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{MinKDFMemory: 1024, MaxKDFMemory: 1023 * 1024})
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+
+	_, err = NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{MinKDFMemory: 1024 * 1024, MinKDFTime: 2})
+	if err != ErrKDFLimits {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrKDFLimits)
+	}
+}
+
+func TestWriterKDFLimits(t *testing.T) {
+	for _, kdf := range []KDF{
+		Argon2Params{CostTime: 1, CostMemory: 1024, CostThreads: 1},
+		Argon2Params{CostTime: 64, CostMemory: 8 * 1024, CostThreads: 1},
+		ScryptParams{CostParam: 1 << 30, CostN: 16, CostP: 1},
+	} {
+		// a default reader would refuse the stream or the slot
+		_, err := NewWriterWithOptions(ioutil.Discard, "password", Options{KDF: kdf})
+		if err != ErrKDFLimits {
+			t.Errorf("unexpected error: %v (vs %v) with %v", err, ErrKDFLimits, kdf)
+		}
+		_, err = NewEnvelopeWriter(ioutil.Discard, PasswordRecipient("password", kdf))
+		if err != ErrKDFLimits {
+			t.Errorf("unexpected error: %v (vs %v) with %v", err, ErrKDFLimits, kdf)
+		}
+	}
+}
+
+func TestReaderOptionsLegacyChunkSize(t *testing.T) {
+	_, err := NewReaderWithOptions(rand.Reader, "password", ReaderOptions{LegacyChunkSize: -1})
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
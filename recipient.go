@@ -0,0 +1,177 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+//
+//
+// RECIPIENTS
+//
+//
+
+const (
+	// envelope slot types
+	slotX25519 = 1
+
+	// ephemeral public key + box of the file key
+	slotX25519Length = 32 + keyLength + box.Overhead
+	// type + length
+	slotHeaderLength = 1 + 2
+)
+
+// slot is a file key wrapped for one credential of an envelope stream.
+type slot struct {
+	typ  uint8
+	body []byte
+}
+
+// marshalSlots serializes the slots of an envelope stream header.
+func marshalSlots(slots []slot) []byte {
+	b := make([]byte, 0, len(slots)*(slotHeaderLength+slotX25519Length))
+	for _, s := range slots {
+		b = append(b, s.typ, byte(len(s.body)>>8), byte(len(s.body)))
+		b = append(b, s.body...)
+	}
+	return b
+}
+
+// unmarshalSlots decodes the slots of an envelope stream header, unknown
+// slot types are kept for the readers that know them.
+func unmarshalSlots(b []byte) ([]slot, error) {
+	slots := []slot{}
+	for len(b) > 0 {
+		if len(b) < slotHeaderLength {
+			return nil, ErrBadHeader
+		}
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < slotHeaderLength+n {
+			return nil, ErrBadHeader
+		}
+		slots = append(slots, slot{typ: b[0], body: b[slotHeaderLength : slotHeaderLength+n]})
+		b = b[slotHeaderLength+n:]
+	}
+	if len(slots) == 0 {
+		return nil, ErrBadHeader
+	}
+	return slots, nil
+}
+
+// sealX25519 wraps 'fileKey' for the X25519 public key 'recipient'.
+func sealX25519(fileKey, recipient *[32]byte) (slot, error) {
+	ephemeralPublic, ephemeralPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return slot{}, err
+	}
+	defer wipe(ephemeralPrivate[:])
+
+	// the ephemeral key is never reused
+	var nonce [24]byte
+	body := append(make([]byte, 0, slotX25519Length), ephemeralPublic[:]...)
+	body = box.Seal(body, fileKey[:], &nonce, recipient, ephemeralPrivate)
+	return slot{typ: slotX25519, body: body}, nil
+}
+
+// openX25519 unwraps the file key of an X25519 slot with 'identity'.
+func openX25519(s slot, identity *[32]byte) (*[32]byte, bool) {
+	if s.typ != slotX25519 || len(s.body) != slotX25519Length {
+		return nil, false
+	}
+
+	var ephemeralPublic [32]byte
+	var nonce [24]byte
+	copy(ephemeralPublic[:], s.body)
+
+	key, ok := box.Open(nil, s.body[32:], &nonce, &ephemeralPublic, identity)
+	if ok != true {
+		return nil, false
+	}
+	fileKey := new([32]byte)
+	copy(fileKey[:], key)
+	wipe(key)
+	return fileKey, true
+}
+
+// openX25519Slots unwraps the file key of an envelope stream into c.dKey
+// with 'identity' and returns the index of the slot it opened with the file
+// key the header commits to.
+func (c *NaclPipe) openX25519Slots(identity *[32]byte) (int, error) {
+	for i, s := range c.slots {
+		fileKey, ok := openX25519(s, identity)
+		if ok != true {
+			continue
+		}
+		copy(c.dKey[:], fileKey[:])
+		wipe(fileKey[:])
+		if c.commits() {
+			return i, nil
+		}
+	}
+	return -1, ErrWrongKey
+}
+
+// GenerateIdentity returns a new X25519 key pair, the public key is a
+// recipient of NewWriterForRecipients and the private key the identity of
+// NewReaderWithIdentity.
+func GenerateIdentity() (publicKey, privateKey *[32]byte, err error) {
+	return box.GenerateKey(rand.Reader)
+}
+
+// NewWriterForRecipients initialize an io.WriteCloser encrypting with a
+// random file key wrapped for each of the X25519 public keys 'recipients',
+// any of their identities decrypts the stream. Close() must be called to
+// terminate the stream.
+// Example:
+//	cryptoWriter, err := naclpipe.NewWriterForRecipients(os.Stdout, alicePublicKey, bobPublicKey)
+//	if err != nil {
+//		return err
+//	}
+//	defer cryptoWriter.Close()
+func NewWriterForRecipients(w io.Writer, recipients ...*[32]byte) (*Writer, error) {
+	wrapped := make([]Recipient, 0, len(recipients))
+	for _, recipient := range recipients {
+		wrapped = append(wrapped, X25519Recipient(recipient))
+	}
+	return NewEnvelopeWriter(w, wrapped...)
+}
+
+// NewReaderWithIdentity initialize an io.Reader decrypting a stream written
+// by NewWriterForRecipients (or NewEnvelopeWriter) for the public key of the
+// X25519 'identity', other streams fail with ErrWrongKey.
+// Example:
+//	cryptoReader, err := naclpipe.NewReaderWithIdentity(os.Stdin, privateKey)
+//	if err != nil {
+//		return err
+//	}
+func NewReaderWithIdentity(r io.Reader, identity *[32]byte) (*Reader, error) {
+	return NewReaderWithIdentityOptions(r, identity, ReaderOptions{})
+}
+
+// NewReaderWithIdentityOptions is NewReaderWithIdentity with the trusted
+// signers and associated data of 'opts'.
+func NewReaderWithIdentityOptions(r io.Reader, identity *[32]byte, opts ReaderOptions) (*Reader, error) {
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+	c.limits = opts
+
+	err := c.useHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.openX25519Slots(identity)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkKey(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{rd: c, format: int(c.version)}, nil
+}
@@ -0,0 +1,137 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// testIdentity returns a new X25519 key pair.
+func testIdentity(t *testing.T) (publicKey, privateKey *[32]byte) {
+	publicKey, privateKey, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("identity error: %v", err)
+	}
+	return publicKey, privateKey
+}
+
+/*
+ *
+ *
+ *
+ *
+ * RECIPIENTS TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestRecipientsRoundTrip(t *testing.T) {
+	alicePublic, alice := testIdentity(t)
+	bobPublic, bob := testIdentity(t)
+	b := []byte("for your eyes only")
+
+	iobuf := new(bytes.Buffer)
+	cw, err := NewWriterForRecipients(iobuf, alicePublic, bobPublic)
+	if err != nil {
+		t.Fatalf("writer error: %v", err)
+	}
+	writeStream(t, cw, b)
+	stream := iobuf.Bytes()
+
+	for _, identity := range []*[32]byte{alice, bob} {
+		cr, err := NewReaderWithIdentity(bytes.NewReader(stream), identity)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+
+		out, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if bytes.Equal(b, out) != true {
+			t.Fatalf("data do not match")
+		}
+	}
+}
+
+func TestRecipientsWrongIdentity(t *testing.T) {
+	alicePublic, _ := testIdentity(t)
+	_, eve := testIdentity(t)
+	stream := encryptStream(t, envelopeWriter(X25519Recipient(alicePublic)), Options{}, []byte("not for eve"))
+
+	_, err := NewReaderWithIdentity(bytes.NewReader(stream), eve)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+
+	// nor for a password or a key
+	_, err = NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+	_, err = NewReaderWithKey(bytes.NewReader(stream), testKey(t))
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestRecipientsOtherStreams(t *testing.T) {
+	_, alice := testIdentity(t)
+
+	stream := encryptStream(t, keyWriter(testKey(t)), Options{}, nil)
+	_, err := NewReaderWithIdentity(bytes.NewReader(stream), alice)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestRecipientsTamperedSlot(t *testing.T) {
+	alicePublic, alice := testIdentity(t)
+	stream := encryptStream(t, envelopeWriter(X25519Recipient(alicePublic)), Options{}, nil)
+
+	// the end of the wrapped file key, right before the chunk size
+	stream[headerFixedLength+slotHeaderLength+slotX25519Length-1] ^= 0x01
+
+	_, err := NewReaderWithIdentity(bytes.NewReader(stream), alice)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestRecipientsNone(t *testing.T) {
+	_, err := NewWriterForRecipients(ioutil.Discard)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestSlotsRoundTrip(t *testing.T) {
+	slots := []slot{
+		{typ: slotX25519, body: make([]byte, slotX25519Length)},
+		// unknown slots are kept
+		{typ: 0xff, body: []byte{1, 2, 3}},
+	}
+
+	out, err := unmarshalSlots(marshalSlots(slots))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != len(slots) || out[1].typ != 0xff || bytes.Equal(out[1].body, slots[1].body) != true {
+		t.Errorf("unexpected slots %v", out)
+	}
+}
+
+func TestSlotsBad(t *testing.T) {
+	b := marshalSlots([]slot{{typ: slotX25519, body: make([]byte, slotX25519Length)}})
+
+	for _, bad := range [][]byte{nil, b[:2], b[:len(b)-1]} {
+		_, err := unmarshalSlots(bad)
+		if err != ErrBadHeader {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrBadHeader)
+		}
+	}
+}
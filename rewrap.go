@@ -0,0 +1,231 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"io"
+)
+
+//
+//
+// REWRAP
+//
+//
+
+const (
+	// padding slot: reserved header space, readers skip it
+	slotPadding = 0
+
+	// header space envelope writers and RewrapTo reserve for in place
+	// rewraps, a password or a couple of X25519 slots
+	rewrapReserve = 256
+)
+
+// Credential unlocks the file key of a stream to rewrap, see
+// PasswordCredential and IdentityCredential.
+type Credential interface {
+	unwrap(c *NaclPipe) (int, error)
+}
+
+// passwordCredential unlocks a password slot.
+type passwordCredential struct {
+	password string
+}
+
+func (p passwordCredential) unwrap(c *NaclPipe) (int, error) {
+	return c.openPasswordSlots(p.password)
+}
+
+// PasswordCredential returns the credential of 'password', it unlocks its
+// slot of an envelope stream.
+func PasswordCredential(password string) Credential {
+	return passwordCredential{password: password}
+}
+
+// identityCredential unlocks an X25519 slot.
+type identityCredential struct {
+	identity *[32]byte
+}
+
+func (i identityCredential) unwrap(c *NaclPipe) (int, error) {
+	return c.openX25519Slots(i.identity)
+}
+
+// IdentityCredential returns the credential of the X25519 'identity', it
+// unlocks its slot of an envelope stream.
+func IdentityCredential(identity *[32]byte) Credential {
+	return identityCredential{identity: identity}
+}
+
+// rewrap reads the stream header from 'r', unlocks its file key with 'old'
+// and replaces the slot it opened by slots for 'recipients'. It returns the
+// pipe holding the file key and the new slots, and the old header length.
+func rewrap(r io.Reader, old Credential, recipients []Recipient) (*NaclPipe, int, error) {
+	c := new(NaclPipe)
+	c.initialize(DerivateArgon2id)
+
+	err := c.useHeader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the key of a password stream is derived from its password, a new
+	// header would not revoke it
+	if c.slots == nil {
+		return nil, 0, ErrNotEnvelope
+	}
+	opened, err := old.unwrap(c)
+	if err != nil {
+		c.wipe()
+		return nil, 0, err
+	}
+
+	// the new header needs the file key unexpanded, its context tag is kept
+	if c.commits() != true {
+		c.wipe()
+		return nil, 0, ErrWrongKey
+	}
+
+	var slots []slot
+	for i, s := range c.slots {
+		if i == opened || s.typ == slotPadding {
+			continue
+		}
+		slots = append(slots, s)
+	}
+	for _, recipient := range recipients {
+		s, err := recipient.wrap(c.dKey)
+		if err != nil {
+			c.wipe()
+			return nil, 0, err
+		}
+		slots = append(slots, s)
+	}
+
+	// nothing would decrypt the stream anymore
+	if len(slots) == 0 {
+		c.wipe()
+		return nil, 0, ErrUnsupported
+	}
+	err = checkPasswordSlots(slots)
+	if err != nil {
+		c.wipe()
+		return nil, 0, err
+	}
+	c.slots = slots
+	return c, int(c.offset), nil
+}
+
+// headerLength returns the length of the pipe header with its key check.
+func (c *NaclPipe) headerLength() (int, error) {
+	raw, err := c.newHeader().marshal()
+	if err != nil {
+		return 0, err
+	}
+	return len(raw) + headerCheckLength, nil
+}
+
+// sealHeader serializes the pipe header padded up to 'size' bytes when
+// there is room for a padding slot, and appends its key check. The salt,
+// nonce prefix and file key are unchanged so the chunks still open, and so
+// are the extensions so a signature still verifies.
+func (c *NaclPipe) sealHeader(size int) ([]byte, error) {
+	n, err := c.headerLength()
+	if err != nil {
+		return nil, err
+	}
+
+	slots := c.slots
+	if pad := size - n; pad >= slotHeaderLength {
+		slots = append(slots[:len(slots):len(slots)], slot{typ: slotPadding, body: make([]byte, pad-slotHeaderLength)})
+	}
+
+	h := c.newHeader()
+	h.slots = slots
+	raw, err := h.marshal()
+	if err != nil {
+		return nil, err
+	}
+	check, err := c.expandKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return append(raw, check...), nil
+}
+
+// Rewrap replaces the slot of the envelope stream in 'rw' that 'old'
+// unlocks by slots for 'recipients', or removes it when there are none,
+// without re-encrypting the data: only the header is rewritten, in place.
+// It returns ErrNotEnvelope for password and keyed streams, whose key only
+// changes by re-encrypting them, ErrHeaderSize, having written nothing, when
+// the new header does not fit in place of the old one (see RewrapTo) and
+// ErrUnsupported when no slot would be left.
+//
+// The header is overwritten with a single write that is not atomic, a
+// crash during it may leave the stream unreadable: keep a copy, or write
+// with RewrapTo and rename, when that matters.
+// Example:
+//	f, err := os.OpenFile("backup.np", os.O_RDWR, 0)
+//	if err != nil {
+//		return err
+//	}
+//	defer f.Close()
+//	err = naclpipe.Rewrap(f, naclpipe.PasswordCredential("leakedpassword"),
+//		naclpipe.PasswordRecipient("n3wp4ssw0rd", nil))
+func Rewrap(rw io.ReadWriteSeeker, old Credential, recipients ...Recipient) error {
+	_, err := rw.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	c, length, err := rewrap(rw, old, recipients)
+	if err != nil {
+		return err
+	}
+	defer c.wipe()
+
+	b, err := c.sealHeader(length)
+	if err != nil {
+		return err
+	}
+	if len(b) != length {
+		return ErrHeaderSize
+	}
+
+	_, err = rw.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = rw.Write(b)
+	if err != nil {
+		return &WriteError{Err: err}
+	}
+	return nil
+}
+
+// RewrapTo is Rewrap copying the stream from 'r' to 'w' with the new
+// header, the chunks are copied as is. The header reserves room for later
+// in place rewraps.
+func RewrapTo(w io.Writer, r io.Reader, old Credential, recipients ...Recipient) error {
+	c, _, err := rewrap(r, old, recipients)
+	if err != nil {
+		return err
+	}
+	defer c.wipe()
+
+	n, err := c.headerLength()
+	if err != nil {
+		return err
+	}
+	b, err := c.sealHeader(n + rewrapReserve)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		return &WriteError{Err: err}
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
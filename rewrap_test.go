@@ -0,0 +1,227 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// rewrapFile writes 'stream' to a temporary file.
+func rewrapFile(t *testing.T, stream []byte) *os.File {
+	f, err := ioutil.TempFile("", "naclpipe")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = f.Write(stream)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return f
+}
+
+// removeFile closes and removes the temporary file 'f'.
+func removeFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// readFile reads the file 'f' from its start.
+func readFile(t *testing.T, f *os.File) []byte {
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b
+}
+
+// decrypts checks that 'open' decrypts 'stream' into 'b'.
+func decrypts(t *testing.T, stream []byte, b []byte, open func(*bytes.Reader) (*Reader, error)) {
+	cr, err := open(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	out, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(b, out) != true {
+		t.Fatalf("data do not match")
+	}
+}
+
+// withPassword opens a stream with 'password'.
+func withPassword(password string) func(*bytes.Reader) (*Reader, error) {
+	return func(r *bytes.Reader) (*Reader, error) {
+		return NewReader(r, password, DerivateArgon2id)
+	}
+}
+
+/*
+ *
+ *
+ *
+ *
+ * REWRAP TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestRewrapReplacePassword(t *testing.T) {
+	b := []byte("rotate the leaked password")
+	stream := encryptStream(t, envelopeWriter(PasswordRecipient("leakedpassword", cheapKDF)), Options{}, b)
+	f := rewrapFile(t, stream)
+	defer removeFile(f)
+
+	err := Rewrap(f, PasswordCredential("leakedpassword"), PasswordRecipient("n3wp4ssw0rd", cheapKDF))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// only the header changed
+	out := readFile(t, f)
+	if len(out) != len(stream) {
+		t.Fatalf("unexpected rewrapped length %d (vs %d)", len(out), len(stream))
+	}
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	offset := len(h.raw) + headerCheckLength
+	if bytes.Equal(out[offset:], stream[offset:]) != true {
+		t.Errorf("chunks were rewritten")
+	}
+
+	decrypts(t, out, b, withPassword("n3wp4ssw0rd"))
+	_, err = NewReader(bytes.NewReader(out), "leakedpassword", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+}
+
+func TestRewrapRemoveSlot(t *testing.T) {
+	opsPublic, ops := testIdentity(t)
+	b := []byte("ops leave")
+	stream := encryptStream(t, envelopeWriter(X25519Recipient(opsPublic), PasswordRecipient("oncallpassword", cheapKDF)), Options{}, b)
+	f := rewrapFile(t, stream)
+	defer removeFile(f)
+
+	// the slot is padded, the header keeps its length
+	err := Rewrap(f, IdentityCredential(ops))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := readFile(t, f)
+
+	decrypts(t, out, b, withPassword("oncallpassword"))
+	_, err = NewReaderWithIdentity(bytes.NewReader(out), ops)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+
+	// the padding makes room for a new slot
+	newPublic, newOps := testIdentity(t)
+	err = Rewrap(f, PasswordCredential("oncallpassword"), X25519Recipient(newPublic), PasswordRecipient("oncallpassword", cheapKDF))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out = readFile(t, f)
+	decrypts(t, out, b, func(r *bytes.Reader) (*Reader, error) {
+		return NewReaderWithIdentity(r, newOps)
+	})
+	decrypts(t, out, b, withPassword("oncallpassword"))
+
+	// the last slot cannot go
+	last := rewrapFile(t, encryptStream(t, envelopeWriter(X25519Recipient(opsPublic)), Options{}, b))
+	defer removeFile(last)
+	err = Rewrap(last, IdentityCredential(ops))
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestRewrapNotEnvelope(t *testing.T) {
+	// their key would survive a new header
+	for _, stream := range [][]byte{
+		encryptStream(t, passwordWriter("leakedpassword"), Options{KDF: cheapKDF}, nil),
+		encryptStream(t, keyWriter(testKey(t)), Options{}, nil),
+	} {
+		f := rewrapFile(t, stream)
+		defer removeFile(f)
+
+		err := Rewrap(f, PasswordCredential("leakedpassword"), PasswordRecipient("n3wp4ssw0rd", cheapKDF))
+		if err != ErrNotEnvelope {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrNotEnvelope)
+		}
+		if bytes.Equal(readFile(t, f), stream) != true {
+			t.Errorf("stream modified")
+		}
+
+		err = RewrapTo(ioutil.Discard, bytes.NewReader(stream), PasswordCredential("leakedpassword"), PasswordRecipient("n3wp4ssw0rd", cheapKDF))
+		if err != ErrNotEnvelope {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrNotEnvelope)
+		}
+	}
+}
+
+func TestRewrapReserve(t *testing.T) {
+	b := []byte("add a recipient")
+	stream := encryptStream(t, envelopeWriter(PasswordRecipient("oncallpassword", cheapKDF)), Options{}, b)
+	f := rewrapFile(t, stream)
+	defer removeFile(f)
+
+	// envelope streams have room for new slots from the start
+	opsPublic, ops := testIdentity(t)
+	err := Rewrap(f, PasswordCredential("oncallpassword"), PasswordRecipient("oncallpassword", cheapKDF), X25519Recipient(opsPublic))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := readFile(t, f)
+	if len(out) != len(stream) {
+		t.Fatalf("unexpected rewrapped length %d (vs %d)", len(out), len(stream))
+	}
+	decrypts(t, out, b, withPassword("oncallpassword"))
+	decrypts(t, out, b, func(r *bytes.Reader) (*Reader, error) {
+		return NewReaderWithIdentity(r, ops)
+	})
+
+	// RewrapTo reserves room as well
+	copied := new(bytes.Buffer)
+	err = RewrapTo(copied, bytes.NewReader(out), IdentityCredential(ops))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	g := rewrapFile(t, copied.Bytes())
+	defer removeFile(g)
+	err = Rewrap(g, PasswordCredential("oncallpassword"), PasswordRecipient("n3wp4ssw0rd", cheapKDF), X25519Recipient(opsPublic))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decrypts(t, readFile(t, g), b, withPassword("n3wp4ssw0rd"))
+}
+
+func TestRewrapWrongCredential(t *testing.T) {
+	opsPublic, _ := testIdentity(t)
+	_, other := testIdentity(t)
+	stream := encryptStream(t, envelopeWriter(X25519Recipient(opsPublic), PasswordRecipient("oncallpassword", cheapKDF)), Options{}, nil)
+	f := rewrapFile(t, stream)
+	defer removeFile(f)
+
+	credentials := []Credential{
+		PasswordCredential("wrongpassword"),
+		IdentityCredential(other),
+	}
+	for _, credential := range credentials {
+		err := Rewrap(f, credential, PasswordRecipient("n3wp4ssw0rd", cheapKDF))
+		if err != ErrWrongKey {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+		}
+	}
+	if bytes.Equal(readFile(t, f), stream) != true {
+		t.Errorf("stream modified")
+	}
+}
@@ -0,0 +1,164 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//
+//
+// SIGNATURES
+//
+//
+
+const (
+	// DetachedSignatureSize is the length of a detached signature: the
+	// Ed25519 public key of the signer followed by the signature.
+	DetachedSignatureSize = ed25519.PublicKeySize + ed25519.SignatureSize
+
+	signatureContext = "naclpipe signature v1"
+	detachedContext  = "naclpipe detached signature v1"
+)
+
+// transcript starts the SHA-512 transcript the signature of a signed stream
+// covers: the header fields but the wrapping of the key (KDF parameters,
+// slots and key check), so that Rewrap keeps the signature valid, then
+// every chunk frame as written.
+func (h *header) transcript() hash.Hash {
+	t := sha512.New()
+	t.Write([]byte(signatureContext))
+	t.Write([]byte{h.version, byte(h.chunkSize >> 24), byte(h.chunkSize >> 16), byte(h.chunkSize >> 8), byte(h.chunkSize)})
+	t.Write(h.salt)
+	t.Write(h.noncePrefix)
+	t.Write(h.marshalExtensions())
+	return t
+}
+
+// sign returns the signature of the stream written so far.
+func (c *NaclPipe) sign() []byte {
+	return ed25519.Sign(c.signer, c.transcript.Sum(nil))
+}
+
+// verifySignature reads the signature following the final chunk and checks
+// it against the transcript.
+func (c *NaclPipe) verifySignature() error {
+	sig := make([]byte, ed25519.SignatureSize)
+	_, err := io.ReadFull(c.rd, sig)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return err
+	}
+	if ed25519.Verify(c.signerKey, c.transcript.Sum(nil), sig) != true {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// trusted reports whether 'signer' is one of 'signers'.
+func trusted(signers []ed25519.PublicKey, signer ed25519.PublicKey) bool {
+	for _, s := range signers {
+		if signer != nil && bytes.Equal(s, signer) {
+			return true
+		}
+	}
+	return false
+}
+
+// trust returns ErrBadSignature when the stream 'signer' (nil for unsigned
+// streams) is not one of the trusted signers.
+func (o ReaderOptions) trust(signer ed25519.PublicKey) error {
+	if len(o.TrustedSigners) > 0 && trusted(o.TrustedSigners, signer) != true {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Signer returns the Ed25519 public key of the signer of a signed stream,
+// nil for unsigned streams. The signature is only verified once Read
+// returned io.EOF.
+func (r *Reader) Signer() ed25519.PublicKey {
+	c, ok := r.rd.(*NaclPipe)
+	if ok != true {
+		return nil
+	}
+	return c.signerKey
+}
+
+// Digest hashes the data of a detached signature, for published files that
+// are not signed streams (or not naclpipe streams at all).
+type Digest struct {
+	h hash.Hash
+}
+
+// NewDigest returns an empty Digest, write the data to it (an
+// io.MultiWriter next to the stream output signs while encrypting).
+func NewDigest() *Digest {
+	d := &Digest{h: sha512.New()}
+	d.h.Write([]byte(detachedContext))
+	return d
+}
+
+// Write adds 'p' to the signed data, it never fails.
+func (d *Digest) Write(p []byte) (int, error) {
+	return d.h.Write(p)
+}
+
+// Sign returns the detached signature of the data written so far.
+func (d *Digest) Sign(signer ed25519.PrivateKey) ([]byte, error) {
+	if len(signer) != ed25519.PrivateKeySize {
+		return nil, ErrUnsupported
+	}
+	sig := append([]byte(nil), signer.Public().(ed25519.PublicKey)...)
+	return append(sig, ed25519.Sign(signer, d.h.Sum(nil))...), nil
+}
+
+// Verify checks the detached 'signature' of the data written so far and
+// returns its signer, it fails with ErrBadSignature if the signature does
+// not verify or its signer is not one of 'signers' (nil accepts any).
+func (d *Digest) Verify(signature []byte, signers []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	if len(signature) != DetachedSignatureSize {
+		return nil, ErrBadSignature
+	}
+	signer := ed25519.PublicKey(signature[:ed25519.PublicKeySize])
+	if len(signers) > 0 && trusted(signers, signer) != true {
+		return nil, ErrBadSignature
+	}
+	if ed25519.Verify(signer, d.h.Sum(nil), signature[ed25519.PublicKeySize:]) != true {
+		return nil, ErrBadSignature
+	}
+	return signer, nil
+}
+
+// SignDetached returns the detached signature of the data read from 'r'.
+// Example:
+//	signature, err := naclpipe.SignDetached(f, signingKey)
+//	if err != nil {
+//		return err
+//	}
+func SignDetached(r io.Reader, signer ed25519.PrivateKey) ([]byte, error) {
+	d := NewDigest()
+	_, err := io.Copy(d, r)
+	if err != nil {
+		return nil, err
+	}
+	return d.Sign(signer)
+}
+
+// VerifyDetached checks the detached 'signature' of the data read from 'r',
+// see Digest.Verify.
+func VerifyDetached(r io.Reader, signature []byte, signers []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	d := NewDigest()
+	_, err := io.Copy(d, r)
+	if err != nil {
+		return nil, err
+	}
+	return d.Verify(signature, signers)
+}
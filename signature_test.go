@@ -0,0 +1,253 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testSigner returns a new Ed25519 key pair.
+func testSigner(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("signing key error: %v", err)
+	}
+	return publicKey, privateKey
+}
+
+// signedReader opens a stream with "password" trusting 'signers'.
+func signedReader(stream []byte, signers ...ed25519.PublicKey) (*Reader, error) {
+	return NewReaderWithOptions(bytes.NewReader(stream), "password", ReaderOptions{TrustedSigners: signers})
+}
+
+/*
+ *
+ *
+ *
+ *
+ * SIGNATURE TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestSignatureRoundTrip(t *testing.T) {
+	publicKey, signer := testSigner(t)
+	b := make([]byte, 3000)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, Signer: signer}, b)
+
+	cr, err := signedReader(stream, publicKey)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	if cr.Format() != FormatV2 || bytes.Equal(cr.Signer(), publicKey) != true {
+		t.Errorf("unexpected format %d signer %x", cr.Format(), cr.Signer())
+	}
+	out, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Equal(b, out) != true {
+		t.Fatalf("data do not match")
+	}
+
+	// without trusted signers the signature is still verified
+	cr, err = signedReader(stream)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	_, err = ioutil.ReadAll(cr)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSignatureUntrusted(t *testing.T) {
+	publicKey, signer := testSigner(t)
+	otherKey, other := testSigner(t)
+
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, Signer: other}, nil)
+	_, err := signedReader(stream, publicKey)
+	if err != ErrBadSignature {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadSignature)
+	}
+
+	// unsigned streams are not trusted either
+	stream = encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024}, nil)
+	_, err = signedReader(stream, publicKey)
+	if err != ErrBadSignature {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadSignature)
+	}
+
+	stream = encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, Signer: signer}, nil)
+	_, err = signedReader(stream, otherKey, publicKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSignatureTampered(t *testing.T) {
+	publicKey, signer := testSigner(t)
+	b := []byte("signed data")
+
+	// the last chunk is withheld until the signature verifies
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, Signer: signer}, b)
+	stream[len(stream)-1] ^= 0x01
+	cr, err := signedReader(stream, publicKey)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	out, err := ioutil.ReadAll(cr)
+	if err != ErrBadSignature || len(out) != 0 {
+		t.Errorf("unexpected read %q error: %v (vs %v)", out, err, ErrBadSignature)
+	}
+
+	// a signed stream ends with its signature
+	stream = encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, Signer: signer}, b)
+	cr, err = signedReader(stream[:len(stream)-ed25519.SignatureSize], publicKey)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	_, err = ioutil.ReadAll(cr)
+	if err != ErrTruncated {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrTruncated)
+	}
+
+	cr, err = signedReader(append(stream, 0), publicKey)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	_, err = ioutil.ReadAll(cr)
+	if err != ErrTrailingData {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrTrailingData)
+	}
+}
+
+func TestSignatureHeaderExtensions(t *testing.T) {
+	_, signer := testSigner(t)
+
+	// unsigned streams keep the FormatV1 header
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024}, nil)
+	cr, err := signedReader(stream)
+	if err != nil {
+		t.Fatalf("reader setup fail: %v", err)
+	}
+	if cr.Format() != FormatV1 || cr.Signer() != nil {
+		t.Errorf("unexpected format %d signer %x", cr.Format(), cr.Signer())
+	}
+
+	// readers reject unknown extensions
+	stream = encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, Signer: signer}, nil)
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream[len(h.raw)-ed25519.PublicKeySize-3] = 0xff
+	_, err = readHeader(bytes.NewReader(stream))
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+
+	_, err = NewWriterWithOptions(ioutil.Discard, "password", Options{Signer: signer[:32]})
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestSignatureKeyAndEnvelope(t *testing.T) {
+	publicKey, signer := testSigner(t)
+	opsPublic, ops := testIdentity(t)
+	key := testKey(t)
+	b := []byte("signed for recipients")
+
+	opts := Options{Signer: signer}
+	envelope := encryptStream(t, envelopeWriter(X25519Recipient(opsPublic), PasswordRecipient("oncallpassword", cheapKDF)), opts, b)
+	keyed := encryptStream(t, keyWriter(key), opts, b)
+
+	// rewrapping keeps the signature
+	f := rewrapFile(t, envelope)
+	defer removeFile(f)
+	err := Rewrap(f, IdentityCredential(ops))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	envelope = readFile(t, f)
+
+	opens := []func() (*Reader, error){
+		func() (*Reader, error) {
+			return NewReaderWithOptions(bytes.NewReader(envelope), "oncallpassword", ReaderOptions{TrustedSigners: []ed25519.PublicKey{publicKey}})
+		},
+		func() (*Reader, error) {
+			return NewReaderWithKey(bytes.NewReader(keyed), key)
+		},
+	}
+	for _, open := range opens {
+		cr, err := open()
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+		out, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if bytes.Equal(b, out) != true || bytes.Equal(cr.Signer(), publicKey) != true {
+			t.Errorf("unexpected read %q signer %x", out, cr.Signer())
+		}
+	}
+
+	_, err = NewEnvelopeWriterWithOptions(ioutil.Discard, Options{KDF: cheapKDF}, X25519Recipient(opsPublic))
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+	_, err = NewWriterWithKeyOptions(ioutil.Discard, key, Options{KDF: cheapKDF})
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestSignatureDetached(t *testing.T) {
+	publicKey, signer := testSigner(t)
+	otherKey, _ := testSigner(t)
+	b := []byte("a published artifact")
+
+	signature, err := SignDetached(bytes.NewReader(b), signer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(signature) != DetachedSignatureSize {
+		t.Fatalf("unexpected signature length %d", len(signature))
+	}
+
+	out, err := VerifyDetached(bytes.NewReader(b), signature, []ed25519.PublicKey{publicKey})
+	if err != nil || bytes.Equal(out, publicKey) != true {
+		t.Errorf("unexpected signer %x error: %v", out, err)
+	}
+
+	for _, bad := range []struct {
+		data    []byte
+		signers []ed25519.PublicKey
+	}{
+		{[]byte("a published artifacT"), nil},
+		{b, []ed25519.PublicKey{otherKey}},
+	} {
+		_, err = VerifyDetached(bytes.NewReader(bad.data), signature, bad.signers)
+		if err != ErrBadSignature {
+			t.Errorf("unexpected error: %v (vs %v)", err, ErrBadSignature)
+		}
+	}
+
+	_, err = VerifyDetached(bytes.NewReader(b), signature[1:], nil)
+	if err != ErrBadSignature {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrBadSignature)
+	}
+}
@@ -0,0 +1,80 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+//
+//
+// DETERMINISTIC STREAMS
+//
+//
+
+// A deterministic stream (see Options.Deterministic) is a keyed stream
+// whose salt is derived from the key and whose chunk nonces are synthetic:
+//
+//	siv        [24]byte  HMAC-SHA256 of the chunk counter, final flag and plaintext
+//	sealed     []byte    AEAD of the plaintext with the siv as nonce
+//
+// each chunk frame carries its siv, the reader checks it against the
+// decrypted plaintext. The same key and plaintext always give the same
+// stream and the same chunk at the same position gives the same frame, a
+// nonce is only ever reused for the very same chunk. The counter and final
+// flag in the siv keep the chunks in order and the stream complete. All the
+// deterministic streams of a key share their chunk key, AES-256-GCM and its
+// 96-bit nonces are not supported.
+const (
+	// synthetic nonce, the AEAD uses its last NonceSize() bytes
+	sivLength = 24
+
+	hkdfInfoSIV           = "naclpipe siv key"
+	hkdfInfoDeterministic = "naclpipe deterministic salt"
+)
+
+// deterministicSalt derives the stream salt from the key and zeroes the
+// unused nonce prefix, the header only depends on the key and options.
+func (c *NaclPipe) deterministicSalt() {
+	mac := hmac.New(sha256.New, c.dKey[:])
+	mac.Write([]byte(hkdfInfoDeterministic))
+	c.salt = mac.Sum(c.salt[:0])
+	wipe(c.noncePrefix)
+}
+
+// siv returns the synthetic nonce of the plaintext 'p' of the current chunk.
+func (c *NaclPipe) siv(p []byte, final bool) []byte {
+	var position [9]byte
+	binary.BigEndian.PutUint64(position[:], c.cnt)
+	if final {
+		position[8] = 1
+	}
+
+	mac := hmac.New(sha256.New, c.sivKey[:])
+	mac.Write(position[:])
+	mac.Write(p)
+	return mac.Sum(nil)[:sivLength]
+}
+
+// sealSIV appends the siv and the sealed plaintext 'p' to 'dst'.
+func (c *NaclPipe) sealSIV(dst, p []byte, final bool) []byte {
+	siv := c.siv(p, final)
+	dst = append(dst, siv...)
+	return c.aead.Seal(dst, siv[sivLength-c.aead.NonceSize():], p, nil)
+}
+
+// openSIV opens the sealed chunk 'b' with its siv and checks the siv.
+func (c *NaclPipe) openSIV(b []byte, final bool) ([]byte, error) {
+	siv := b[:sivLength]
+	pt, err := c.aead.Open(nil, siv[sivLength-c.aead.NonceSize():], b[sivLength:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if hmac.Equal(siv, c.siv(pt, final)) != true {
+		wipe(pt)
+		return nil, ErrRead
+	}
+	return pt, nil
+}
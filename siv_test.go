@@ -0,0 +1,151 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// deterministicFrames splits a deterministic stream of 1024 bytes chunks
+// in its header and chunk frames.
+func deterministicFrames(t *testing.T, stream []byte) [][]byte {
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := len(h.raw) + headerCheckLength
+	frames := [][]byte{stream[:n]}
+	for stream = stream[n:]; len(stream) > frameHeaderLength+sivLength+1024+16; stream = stream[frameHeaderLength+sivLength+1024+16:] {
+		frames = append(frames, stream[:frameHeaderLength+sivLength+1024+16])
+	}
+	return append(frames, stream)
+}
+
+/*
+ *
+ *
+ *
+ *
+ * DETERMINISTIC TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestDeterministicRoundTrip(t *testing.T) {
+	key := testKey(t)
+	b := make([]byte, 3000)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+
+	for _, suite := range []CipherSuite{SuiteSecretbox, SuiteXChaCha20Poly1305} {
+		opts := Options{ChunkSize: 1024, CipherSuite: suite, Deterministic: true}
+		stream := encryptStream(t, keyWriter(key), opts, b)
+
+		h, err := readHeader(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if h.deterministic != true || h.version != FormatV2 {
+			t.Errorf("%v: unexpected header %v format %d", suite, h.deterministic, h.version)
+		}
+
+		// the same key and plaintext give the same stream
+		if bytes.Equal(stream, encryptStream(t, keyWriter(key), opts, b)) != true {
+			t.Errorf("%v: streams do not match", suite)
+		}
+		if bytes.Equal(stream, encryptStream(t, keyWriter(testKey(t)), opts, b)) == true {
+			t.Errorf("%v: streams of different keys match", suite)
+		}
+
+		cr, err := NewReaderWithKey(bytes.NewReader(stream), key)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+		out, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", suite, err)
+		}
+		if bytes.Equal(b, out) != true {
+			t.Fatalf("%v: data do not match", suite)
+		}
+	}
+}
+
+func TestDeterministicChunks(t *testing.T) {
+	key := testKey(t)
+	b := make([]byte, 3000)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+	edited := append([]byte(nil), b...)
+	edited[1500] ^= 0x01
+
+	opts := Options{ChunkSize: 1024, CipherSuite: SuiteSecretbox, Deterministic: true}
+	frames := deterministicFrames(t, encryptStream(t, keyWriter(key), opts, b))
+	editedFrames := deterministicFrames(t, encryptStream(t, keyWriter(key), opts, edited))
+	if len(frames) != 4 || len(editedFrames) != 4 {
+		t.Fatalf("unexpected frames %d %d", len(frames), len(editedFrames))
+	}
+
+	// only the edited chunk differs
+	for i := range frames {
+		if bytes.Equal(frames[i], editedFrames[i]) != (i != 2) {
+			t.Errorf("unexpected frame %d", i)
+		}
+	}
+}
+
+func TestDeterministicTampered(t *testing.T) {
+	key := testKey(t)
+	opts := Options{ChunkSize: 1024, CipherSuite: SuiteXChaCha20Poly1305, Deterministic: true}
+	stream := encryptStream(t, keyWriter(key), opts, make([]byte, 3000))
+	frames := deterministicFrames(t, stream)
+
+	// a forged siv, and equal chunks swapped
+	forged := append([]byte(nil), stream...)
+	forged[len(frames[0])+frameHeaderLength] ^= 0x01
+	swapped := append([]byte(nil), frames[0]...)
+	swapped = append(swapped, frames[2]...)
+	swapped = append(swapped, frames[1]...)
+	swapped = append(swapped, frames[3]...)
+
+	for _, tampered := range [][]byte{forged, swapped} {
+		cr, err := NewReaderWithKey(bytes.NewReader(tampered), key)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+		_, err = ioutil.ReadAll(cr)
+		if authErr, ok := err.(*AuthError); ok != true || authErr.Chunk != 0 {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestDeterministicUnsupported(t *testing.T) {
+	opts := Options{KDF: cheapKDF, Deterministic: true}
+	_, err := NewWriterWithOptions(ioutil.Discard, "password", opts)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+
+	opts.KDF = nil
+	_, err = NewEnvelopeWriterWithOptions(ioutil.Discard, opts, PasswordRecipient("password", cheapKDF))
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+
+	// 96-bit nonces under a chunk key shared by every stream of the key
+	opts = Options{CipherSuite: SuiteAES256GCM, Deterministic: true}
+	_, err = NewWriterWithKeyOptions(ioutil.Discard, new([32]byte), opts)
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
@@ -0,0 +1,114 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+//
+// CIPHER SUITES
+//
+//
+
+// CipherSuite is the AEAD sealing the chunks of a stream, it is recorded in
+// the stream header (see Options.CipherSuite).
+type CipherSuite uint8
+
+const (
+	// SuiteSecretbox is NaCl secretbox (XSalsa20-Poly1305), the default.
+	SuiteSecretbox CipherSuite = iota
+	// SuiteXChaCha20Poly1305 is the XChaCha20-Poly1305 AEAD.
+	SuiteXChaCha20Poly1305
+	// SuiteAES256GCM is AES-256-GCM, hardware accelerated on most x86 and
+	// arm64 CPUs.
+	SuiteAES256GCM
+)
+
+// String returns the name of the suite.
+func (s CipherSuite) String() string {
+	switch s {
+	case SuiteSecretbox:
+		return "secretbox"
+	case SuiteXChaCha20Poly1305:
+		return "xchacha20poly1305"
+	case SuiteAES256GCM:
+		return "aes256gcm"
+	}
+	return "unknown"
+}
+
+// valid reports whether the suite is supported.
+func (s CipherSuite) valid() bool {
+	return s <= SuiteAES256GCM
+}
+
+// hkdfInfo returns the HKDF label of the chunk key of the suite, a key is
+// never shared between suites.
+func (s CipherSuite) hkdfInfo() string {
+	if s == SuiteSecretbox {
+		return hkdfInfoChunk
+	}
+	return hkdfInfoChunk + " " + s.String()
+}
+
+// aead returns the AEAD of the suite keyed with the chunk 'key'. The chunk
+// nonce is the last NonceSize() bytes of the 24 bytes nonce (see
+// chunkNonce): the full nonce for secretbox and XChaCha20-Poly1305, the end
+// of the prefix, the counter and the final flag for AES-256-GCM, unique as
+// every stream has its own chunk key.
+func (s CipherSuite) aead(key *[32]byte) (cipher.AEAD, error) {
+	switch s {
+	case SuiteSecretbox:
+		return secretboxAEAD{key: key}, nil
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key[:])
+	case SuiteAES256GCM:
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, ErrUnsupported
+}
+
+// secretboxAEAD is secretbox as a cipher.AEAD, it has no additional data.
+type secretboxAEAD struct {
+	key *[32]byte
+}
+
+func (a secretboxAEAD) NonceSize() int {
+	return 24
+}
+
+func (a secretboxAEAD) Overhead() int {
+	return secretbox.Overhead
+}
+
+func (a secretboxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(additionalData) > 0 {
+		panic("naclpipe: secretbox has no additional data")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, a.key)
+}
+
+func (a secretboxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) > 0 {
+		panic("naclpipe: secretbox has no additional data")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	out, ok := secretbox.Open(dst, ciphertext, &n, a.key)
+	if ok != true {
+		return nil, ErrRead
+	}
+	return out, nil
+}
@@ -0,0 +1,118 @@
+// +build go1.10
+
+package naclpipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+/*
+ *
+ *
+ *
+ *
+ * CIPHER SUITE TESTING
+ *
+ *
+ *
+ *
+ */
+
+func TestSuiteRoundTrip(t *testing.T) {
+	b := make([]byte, 3000)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatalf("reading rand error: %v", err)
+	}
+
+	for suite, format := range map[CipherSuite]int{
+		SuiteSecretbox:         FormatV1,
+		SuiteXChaCha20Poly1305: FormatV2,
+		SuiteAES256GCM:         FormatV2,
+	} {
+		stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, CipherSuite: suite}, b)
+
+		h, err := readHeader(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if h.suite != suite || int(h.version) != format {
+			t.Errorf("unexpected suite %v format %d (vs %v %d)", h.suite, h.version, suite, format)
+		}
+
+		cr, err := NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+		out, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", suite, err)
+		}
+		if bytes.Equal(b, out) != true {
+			t.Fatalf("%v: data do not match", suite)
+		}
+	}
+}
+
+func TestSuiteCorruptedChunk(t *testing.T) {
+	for _, suite := range []CipherSuite{SuiteXChaCha20Poly1305, SuiteAES256GCM} {
+		stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, CipherSuite: suite}, make([]byte, 2048))
+		stream[len(stream)-1] ^= 0x01
+
+		cr, err := NewReader(bytes.NewReader(stream), "password", DerivateArgon2id)
+		if err != nil {
+			t.Fatalf("reader setup fail: %v", err)
+		}
+		_, err = ioutil.ReadAll(cr)
+		if authErr, ok := err.(*AuthError); ok != true || authErr.Chunk != 1 {
+			t.Errorf("%v: unexpected error: %v", suite, err)
+		}
+	}
+}
+
+func TestSuiteHeader(t *testing.T) {
+	stream := encryptStream(t, passwordWriter("password"), Options{KDF: cheapKDF, ChunkSize: 1024, CipherSuite: SuiteAES256GCM}, nil)
+	h, err := readHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	suite := len(h.raw) - 1
+
+	// the suite is covered by the key check
+	tampered := append([]byte(nil), stream...)
+	tampered[suite] = byte(SuiteXChaCha20Poly1305)
+	_, err = NewReader(bytes.NewReader(tampered), "password", DerivateArgon2id)
+	if err != ErrWrongKey {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrWrongKey)
+	}
+
+	for value, expected := range map[byte]error{
+		byte(SuiteSecretbox): ErrBadHeader,
+		0xff:                 ErrUnsupported,
+	} {
+		tampered[suite] = value
+		_, err = readHeader(bytes.NewReader(tampered))
+		if err != expected {
+			t.Errorf("unexpected error: %v (vs %v)", err, expected)
+		}
+	}
+
+	_, err = NewWriterWithOptions(ioutil.Discard, "password", Options{CipherSuite: 0xff})
+	if err != ErrUnsupported {
+		t.Errorf("unexpected error: %v (vs %v)", err, ErrUnsupported)
+	}
+}
+
+func TestSuiteChunkKeys(t *testing.T) {
+	// a chunk key is never shared between suites
+	labels := make(map[string]bool)
+	for _, suite := range []CipherSuite{SuiteSecretbox, SuiteXChaCha20Poly1305, SuiteAES256GCM} {
+		labels[suite.hkdfInfo()] = true
+	}
+	if len(labels) != 3 || labels[hkdfInfoChunk] != true {
+		t.Errorf("unexpected chunk key labels %v", labels)
+	}
+}